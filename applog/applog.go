@@ -0,0 +1,46 @@
+package applog
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+//seqPrefixLen is how many characters of a sequence are logged
+const seqPrefixLen = 20
+
+//New returns a structured logger writing to w, format is json or logfmt and level is debug, info, warn or error
+func New(w io.Writer, format string, level string) (*slog.Logger, error) {
+	var lv slog.Level
+	err := lv.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lv}
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "", "logfmt", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, errors.New("unknown log format " + format)
+}
+
+//Setup installs a logger writing to stdout as the default one
+func Setup(format string, level string) error {
+	l, err := New(os.Stdout, format, level)
+	if err == nil {
+		slog.SetDefault(l)
+	}
+	return err
+}
+
+//Seq shortens an opaque sequence for logs
+func Seq(seq string) string {
+	if len(seq) > seqPrefixLen {
+		return seq[:seqPrefixLen]
+	}
+	return seq
+}
@@ -0,0 +1,167 @@
+package checkpoint
+
+import (
+	"couch2mq/couchdb"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//Checkpointer stores the sequence a pipeline resumes from
+type Checkpointer interface {
+	//Seq returns the latest checkpoint, empty when there is none yet
+	Seq() (string, error)
+	//Update records seq after the change of docid was handled, inerr is what it failed with
+	Update(seq string, docid string, inerr error) error
+}
+
+//Record is the content of a checkpoint document or file
+type Record struct {
+	LastSeq string `json:"last_seq"`
+	DocID   string `json:"docid"`
+	Error   string `json:"error"`
+	Updated string `json:"updated"`
+}
+
+func newRecord(seq string, docid string, inerr error) Record {
+	r := Record{
+		LastSeq: seq,
+		DocID:   docid,
+		Error:   "nil",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+	}
+	if inerr != nil {
+		r.Error = inerr.Error()
+	}
+	return r
+}
+
+//Local keeps the checkpoint in a _local document of CouchDB, like replications do
+type Local struct {
+	db *couchdb.DB
+	id string
+	//mu guards rev, which only Update sets so that Seq can be called from any goroutine
+	mu  sync.Mutex
+	rev string
+}
+
+//localDoc is a Record along with the id and revision of the document
+type localDoc struct {
+	ID  string `json:"_id"`
+	Rev string `json:"_rev,omitempty"`
+	Record
+}
+
+//NewLocal returns a checkpoint stored in _local/couch2mq-<pipeline> of db
+func NewLocal(db *couchdb.DB, pipeline string) *Local {
+	return &Local{
+		db: db,
+		id: "_local/couch2mq-" + pipeline,
+	}
+}
+
+//load reads the checkpoint document, it is empty when there is none yet
+func (l *Local) load() (localDoc, error) {
+	var doc localDoc
+	err := l.db.Get(l.id, &doc)
+	var he *couchdb.HTTPError
+	if errors.As(err, &he) && he.StatusCode == http.StatusNotFound {
+		return localDoc{}, nil
+	}
+	return doc, err
+}
+
+//Seq see Checkpointer
+func (l *Local) Seq() (string, error) {
+	doc, err := l.load()
+	return doc.LastSeq, err
+}
+
+//Update see Checkpointer
+func (l *Local) Update(seq string, docid string, inerr error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.rev) == 0 {
+		//the document may have been written by an earlier run
+		doc, err := l.load()
+		if err != nil {
+			return err
+		}
+		l.rev = doc.Rev
+	}
+	doc := localDoc{
+		ID:     l.id,
+		Rev:    l.rev,
+		Record: newRecord(seq, docid, inerr),
+	}
+	rev, err := l.db.Put(l.id, doc)
+	if err == nil {
+		l.rev = rev
+		return nil
+	}
+	//someone else wrote the document, reload its revision so that the next update succeeds
+	var he *couchdb.HTTPError
+	if errors.As(err, &he) && he.StatusCode == http.StatusConflict {
+		if cur, lerr := l.load(); lerr == nil {
+			l.rev = cur.Rev
+		}
+	}
+	return err
+}
+
+//File keeps the checkpoint in a JSON file which is replaced atomically
+type File struct {
+	path string
+}
+
+//NewFile returns a checkpoint stored in path
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+//Seq see Checkpointer
+func (f *File) Seq() (string, error) {
+	b, err := ioutil.ReadFile(f.path)
+	if err == nil {
+		var r Record
+		err = json.Unmarshal(b, &r)
+		if err == nil {
+			return r.LastSeq, nil
+		}
+		return "", err
+	}
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return "", err
+}
+
+//Update see Checkpointer
+func (f *File) Update(seq string, docid string, inerr error) error {
+	b, err := json.Marshal(newRecord(seq, docid, inerr))
+	if err == nil {
+		var tmp *os.File
+		tmp, err = ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+		if err == nil {
+			_, err = tmp.Write(b)
+			if err == nil {
+				err = tmp.Sync()
+			}
+			if cerr := tmp.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				err = os.Rename(tmp.Name(), f.path)
+			}
+			if err != nil {
+				os.Remove(tmp.Name())
+			}
+		}
+	}
+	return err
+}
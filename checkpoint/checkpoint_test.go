@@ -0,0 +1,174 @@
+package checkpoint
+
+import (
+	"couch2mq/couchdb"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	f := NewFile(filepath.Join(dir, "orders.json"))
+	seq, err := f.Seq()
+	if err != nil || seq != "" {
+		t.Fatalf("Seq of a missing file is %q, %v", seq, err)
+	}
+	if err = f.Update("1-a", "order-1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Update("2-b", "order-2", errors.New("wrong format")); err != nil {
+		t.Fatal(err)
+	}
+	seq, err = f.Seq()
+	if err != nil || seq != "2-b" {
+		t.Fatalf("Seq is %q, %v, want 2-b", seq, err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "orders.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Record
+	if err = json.Unmarshal(b, &r); err != nil || r.DocID != "order-2" || r.Error != "wrong format" {
+		t.Errorf("record is %s, %v", b, err)
+	}
+	//the temporary file is renamed over the checkpoint, nothing else is left behind
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 {
+		t.Errorf("directory holds %v", files)
+	}
+}
+
+func TestFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	f := NewFile(filepath.Join(dir, "missing", "orders.json"))
+	if err := f.Update("1-a", "order-1", nil); err == nil {
+		t.Error("Update into a missing directory succeeded")
+	}
+	path := filepath.Join(dir, "corrupt.json")
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFile(path).Seq(); err == nil {
+		t.Error("Seq of a corrupt file succeeded")
+	}
+}
+
+//fakeCouch serves one _local document, the revision is checked on PUT like CouchDB does
+type fakeCouch struct {
+	mu   sync.Mutex
+	doc  map[string]interface{}
+	gen  int
+	puts int
+}
+
+func (s *fakeCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path != "/orders/_local/couch2mq-orders" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		if s.doc == nil {
+			http.Error(w, `{"error":"not_found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(s.doc)
+	case "PUT":
+		s.puts++
+		var doc map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&doc)
+		if s.doc != nil && doc["_rev"] != s.doc["_rev"] {
+			http.Error(w, `{"error":"conflict"}`, http.StatusConflict)
+			return
+		}
+		s.write(doc)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "rev": s.doc["_rev"]})
+	}
+}
+
+//write stores doc under the next revision, the caller holds mu
+func (s *fakeCouch) write(doc map[string]interface{}) {
+	s.gen++
+	doc["_rev"] = fmt.Sprintf("0-%d", s.gen)
+	s.doc = doc
+}
+
+func newLocal(t *testing.T, s *fakeCouch) *Local {
+	t.Helper()
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	client, err := couchdb.New(server.URL, nil, couchdb.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := client.DB("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewLocal(db, "orders")
+}
+
+func TestLocal(t *testing.T) {
+	s := &fakeCouch{}
+	l := newLocal(t, s)
+	seq, err := l.Seq()
+	if err != nil || seq != "" {
+		t.Fatalf("Seq of a missing document is %q, %v", seq, err)
+	}
+	for _, seq := range []string{"1-a", "2-b"} {
+		if err = l.Update(seq, "order-1", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seq, err = l.Seq()
+	if err != nil || seq != "2-b" {
+		t.Fatalf("Seq is %q, %v, want 2-b", seq, err)
+	}
+}
+
+func TestLocalExisting(t *testing.T) {
+	s := &fakeCouch{}
+	s.write(map[string]interface{}{"_id": "_local/couch2mq-orders", "last_seq": "5-e"})
+	l := newLocal(t, s)
+	//the revision of a document written by an earlier run is loaded by the first update
+	if err := l.Update("6-f", "order-6", nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.puts != 1 {
+		t.Errorf("%d puts, want 1", s.puts)
+	}
+}
+
+func TestLocalConflict(t *testing.T) {
+	s := &fakeCouch{}
+	l := newLocal(t, s)
+	if err := l.Update("1-a", "order-1", nil); err != nil {
+		t.Fatal(err)
+	}
+	//someone else writes the document, the next update is rejected once
+	s.mu.Lock()
+	s.write(map[string]interface{}{"_id": "_local/couch2mq-orders", "last_seq": "9-z"})
+	s.mu.Unlock()
+	err := l.Update("2-b", "order-2", nil)
+	var he *couchdb.HTTPError
+	if !errors.As(err, &he) || he.StatusCode != http.StatusConflict {
+		t.Fatalf("Update returned %v, want a conflict", err)
+	}
+	if err = l.Update("2-b", "order-2", nil); err != nil {
+		t.Fatalf("Update after a conflict returned %v", err)
+	}
+	seq, err := l.Seq()
+	if err != nil || seq != "2-b" {
+		t.Fatalf("Seq is %q, %v, want 2-b", seq, err)
+	}
+}
@@ -2,28 +2,602 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
-
-	"github.com/NodePrime/jsonpath"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-var cfgData []byte
+//DefaultPath is the configuration file used when no path is given
+const DefaultPath = "conf.json"
+
+//EnvPrefix starts the names of environment variables which override configuration,
+//e.g. COUCH2MQ_MYSQL_SSH_PASSWORD overrides mysql.ssh.password
+const EnvPrefix = "COUCH2MQ_"
+
+//numeric lists keys whose environment overrides are numbers
+var numeric = map[string]bool{
+	"couchdb.heartbeat":       true,
+	"couchdb.timeout":         true,
+	"couchdb.connecttimeout":  true,
+	"couchdb.tlstimeout":      true,
+	"couchdb.responsetimeout": true,
+	"mysql.port":              true,
+	"mysql.ssh.port":          true,
+	"mysql.ssh.keepalive":     true,
+	"retry.maxattempts":       true,
+	"retry.basebackoff":       true,
+	"retry.maxbackoff":        true,
+	"retry.jitter":            true,
+	"http.staleness":          true,
+	"http.readystaleness":     true,
+	"pipelines.orders.batch":  true,
+	"pipelines.orders.linger": true,
+	"pipelines.shifts.batch":  true,
+	"pipelines.shifts.linger": true,
+}
+
+//boolean lists keys whose environment overrides are booleans
+var boolean = map[string]bool{
+	"couchdb.insecure":   true,
+	"mysql.ssh.agent":    true,
+	"mysql.ssh.insecure": true,
+}
+
+//CouchDB holds connection and change feeds settings of CouchDB
+type CouchDB struct {
+	URL string `json:"url"`
+	//Auth is one of basic, cookie, jwt and proxy, Username and Password are used by basic and cookie
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	//Token or TokenFile hold the bearer token of jwt, the file is reread when the token is rejected
+	Token     string `json:"token"`
+	TokenFile string `json:"tokenfile"`
+	//Roles and Secret are sent with Username by proxy, the token is only signed when Secret is set
+	Roles  []string `json:"roles"`
+	Secret string   `json:"secret"`
+	//Feed is one of continuous, longpoll and normal
+	Feed string `json:"feed"`
+	//Heartbeat and Timeout are in milliseconds
+	Heartbeat int `json:"heartbeat"`
+	Timeout   int `json:"timeout"`
+	//CA, Cert and Key are PEM files, Insecure skips verification of the server certificate
+	CA         string `json:"ca"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ServerName string `json:"servername"`
+	Insecure   bool   `json:"insecure"`
+	//Proxy is the URL of the HTTP proxy, HTTP_PROXY and friends are used when it is empty
+	Proxy string `json:"proxy"`
+	//ConnectTimeout, TLSTimeout and ResponseTimeout are in milliseconds, ResponseTimeout bounds waiting for response headers
+	ConnectTimeout  int `json:"connecttimeout"`
+	TLSTimeout      int `json:"tlstimeout"`
+	ResponseTimeout int `json:"responsetimeout"`
+}
+
+//SSH holds settings of the SSH bastion in front of MySQL
+type SSH struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	//Password, KeyFile and Agent are tried in the order agent, key file, password
+	Password   string `json:"password"`
+	KeyFile    string `json:"keyfile"`
+	Passphrase string `json:"passphrase"`
+	Agent      bool   `json:"agent"`
+	//KnownHosts is a known_hosts file, Fingerprint is a pinned host key like SHA256:...
+	KnownHosts  string `json:"knownhosts"`
+	Fingerprint string `json:"fingerprint"`
+	//Insecure skips host key verification, only meant for testing
+	Insecure bool `json:"insecure"`
+	//Keepalive is the interval of keepalive requests in milliseconds, a dead session is redialed
+	Keepalive int `json:"keepalive"`
+	//Jumps are hopped in order before this host is reached, each with its own auth
+	Jumps []SSH `json:"jumps"`
+}
+
+//TLS holds settings of the encrypted connection to MySQL
+type TLS struct {
+	CA         string `json:"ca"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ServerName string `json:"servername"`
+	//Verify is one of full, ca and skip
+	Verify string `json:"verify"`
+}
+
+//MySQL holds connection settings of MySQL, SSH is nil when MySQL is reached directly and TLS is nil for plain connections
+type MySQL struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Database string `json:"database"`
+	SSH      *SSH   `json:"ssh"`
+	TLS      *TLS   `json:"tls"`
+}
+
+//Pipeline holds settings of one pipeline
+type Pipeline struct {
+	Database string `json:"database"`
+	//Filter is nil when every change of the database is followed
+	Filter     *Filter    `json:"filter"`
+	Checkpoint Checkpoint `json:"checkpoint"`
+	//Batch changes are applied along with their checkpoint in one MySQL transaction,
+	//a batch is cut short when no change arrives for Linger milliseconds
+	Batch  int `json:"batch"`
+	Linger int `json:"linger"`
+	//Exchange, RoutingKey and Topic override those of the amqp and kafka sinks for this pipeline
+	Exchange   string `json:"exchange"`
+	RoutingKey string `json:"routingkey"`
+	Topic      string `json:"topic"`
+}
+
+//Route returns s with the exchange, routing key and topic of the pipeline
+func (p Pipeline) Route(s Sink) Sink {
+	if len(p.Exchange) > 0 {
+		s.Exchange = p.Exchange
+	}
+	if len(p.RoutingKey) > 0 {
+		s.RoutingKey = p.RoutingKey
+	}
+	if len(p.Topic) > 0 {
+		s.Topic = p.Topic
+	}
+	return s
+}
+
+//Checkpoint selects where a pipeline keeps the sequence it resumes from
+type Checkpoint struct {
+	//Type is one of mysql, couchdb and file
+	Type string `json:"type"`
+	//Path is the file of the file type
+	Path string `json:"path"`
+}
+
+//DeadLetter selects where changes which fail to apply are kept
+type DeadLetter struct {
+	//Type is mysql or file, it defaults to mysql when a pipeline uses MySQL anyway
+	Type string `json:"type"`
+	//Path is the directory of the file type
+	Path string `json:"path"`
+}
+
+//Filter restricts the change feed of a pipeline
+type Filter struct {
+	//Type is one of _selector, _doc_ids, _view or a design filter like ddoc/name
+	Type     string            `json:"type"`
+	Selector json.RawMessage   `json:"selector"`
+	DocIDs   []string          `json:"docids"`
+	View     string            `json:"view"`
+	Params   map[string]string `json:"params"`
+}
+
+//Sink holds settings of the sink, fields other than Type depend on the type
+type Sink struct {
+	Type       string   `json:"type"`
+	URL        string   `json:"url"`
+	Exchange   string   `json:"exchange"`
+	RoutingKey string   `json:"routingkey"`
+	Brokers    []string `json:"brokers"`
+	Topic      string   `json:"topic"`
+}
+
+//Retry holds the retry policy, backoffs are in milliseconds
+type Retry struct {
+	MaxAttempts int     `json:"maxattempts"`
+	BaseBackoff int     `json:"basebackoff"`
+	MaxBackoff  int     `json:"maxbackoff"`
+	Jitter      float64 `json:"jitter"`
+}
+
+//HTTP holds settings of the HTTP server exposing /metrics, /healthz and /readyz, it is disabled when Listen is empty.
+//A pipeline is unhealthy when it has not looped for Staleness milliseconds and not ready after ReadyStaleness milliseconds.
+type HTTP struct {
+	Listen         string `json:"listen"`
+	Staleness      int    `json:"staleness"`
+	ReadyStaleness int    `json:"readystaleness"`
+}
 
-func init() {
-	cfgData, _ = ioutil.ReadFile("conf.json")
+//Log holds settings of logs, Format is json or logfmt and Level is debug, info, warn or error
+type Log struct {
+	Format string `json:"format"`
+	Level  string `json:"level"`
 }
 
-//Get config value
-func Get(p string, value interface{}) error {
-	paths, err := jsonpath.ParsePaths(p)
+//Config is the whole configuration
+type Config struct {
+	CouchDB   CouchDB             `json:"couchdb"`
+	MySQL     MySQL               `json:"mysql"`
+	Pipelines map[string]Pipeline `json:"pipelines"`
+	Sink      Sink                `json:"sink"`
+	//DeadLetter is shared by all pipelines
+	DeadLetter DeadLetter `json:"deadletter"`
+	Retry      Retry      `json:"retry"`
+	HTTP       HTTP       `json:"http"`
+	Log        Log        `json:"log"`
+}
+
+//Errors collects all problems found in configuration
+type Errors []string
+
+func (e Errors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+//Default returns the configuration used for keys which are not given
+func Default() *Config {
+	return &Config{
+		CouchDB: CouchDB{
+			Auth:            "basic",
+			Feed:            "continuous",
+			Heartbeat:       30000,
+			Timeout:         60000,
+			ConnectTimeout:  10000,
+			TLSTimeout:      10000,
+			ResponseTimeout: 90000,
+		},
+		MySQL: MySQL{
+			Port: 3306,
+		},
+		Sink: Sink{
+			Type: "mysql",
+		},
+		Retry: Retry{
+			MaxAttempts: 5,
+			BaseBackoff: 500,
+			MaxBackoff:  30000,
+			Jitter:      0.2,
+		},
+		HTTP: HTTP{
+			Listen:         ":9102",
+			Staleness:      300000,
+			ReadyStaleness: 120000,
+		},
+		Log: Log{
+			Format: "logfmt",
+			Level:  "info",
+		},
+	}
+}
+
+//Load reads configuration from path, applies environment overrides and defaults, then validates it.
+//A missing default file is allowed so that everything can come from environment.
+func Load(path string) (*Config, error) {
+	tree := make(map[string]interface{})
+	data, err := ioutil.ReadFile(path)
 	if err == nil {
-		eval, err := jsonpath.EvalPathsInBytes(cfgData, paths)
+		err = json.Unmarshal(data, &tree)
+		if err != nil {
+			return nil, errors.New(path + ": " + err.Error())
+		}
+	} else if !(os.IsNotExist(err) && path == DefaultPath) {
+		return nil, err
+	}
+	override(tree, os.Environ())
+	data, err = json.Marshal(tree)
+	if err == nil {
+		cfg := Default()
+		err = json.Unmarshal(data, cfg)
 		if err == nil {
-			if result, ok := eval.Next(); ok {
-				return json.Unmarshal([]byte(result.Pretty(false)), &value)
+			cfg.fill()
+			err = cfg.Validate()
+			if err == nil {
+				return cfg, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+//fill sets defaults of nested and optional sections
+func (c *Config) fill() {
+	if c.MySQL.SSH != nil && c.MySQL.SSH.Port == 0 {
+		c.MySQL.SSH.Port = 22
+	}
+	if c.MySQL.SSH != nil && c.MySQL.SSH.Keepalive == 0 {
+		c.MySQL.SSH.Keepalive = 15000
+	}
+	if c.MySQL.SSH != nil {
+		for i := range c.MySQL.SSH.Jumps {
+			if c.MySQL.SSH.Jumps[i].Port == 0 {
+				c.MySQL.SSH.Jumps[i].Port = 22
+			}
+		}
+	}
+	if c.MySQL.TLS != nil && c.MySQL.TLS.Verify == "" {
+		c.MySQL.TLS.Verify = "full"
+	}
+	if c.Pipelines == nil {
+		c.Pipelines = make(map[string]Pipeline)
+	}
+	if _, ok := c.Pipelines["orders"]; !ok {
+		c.Pipelines["orders"] = Pipeline{}
+	}
+	for name, p := range c.Pipelines {
+		if len(p.Database) == 0 {
+			p.Database = name
+		}
+		if len(p.Checkpoint.Type) == 0 {
+			p.Checkpoint.Type = "mysql"
+		}
+		if p.Batch == 0 {
+			p.Batch = 1
+		}
+		if p.Linger == 0 {
+			p.Linger = 1000
+		}
+		c.Pipelines[name] = p
+	}
+	if len(c.DeadLetter.Type) == 0 {
+		c.DeadLetter.Type = "file"
+		for _, p := range c.Pipelines {
+			if c.Sink.Type == "mysql" || p.Checkpoint.Type == "mysql" {
+				c.DeadLetter.Type = "mysql"
+			}
+		}
+	}
+	if c.DeadLetter.Type == "file" && len(c.DeadLetter.Path) == 0 {
+		c.DeadLetter.Path = "deadletters"
+	}
+}
+
+//UsesMySQL tells whether pipeline p reads or writes MySQL, for its sink, its checkpoint or dead letters
+func (c *Config) UsesMySQL(p Pipeline) bool {
+	return c.Sink.Type == "mysql" || p.Checkpoint.Type == "mysql" || c.DeadLetter.Type == "mysql"
+}
+
+//Validate reports all problems of configuration at once
+func (c *Config) Validate() error {
+	errs := make(Errors, 0)
+	requireString := func(key string, value string) {
+		if len(value) == 0 {
+			errs = append(errs, key+" is required")
+		}
+	}
+	requirePort := func(key string, value int) {
+		if value <= 0 || value > 65535 {
+			errs = append(errs, fmt.Sprintf("%s %d is not a valid port", key, value))
+		}
+	}
+	requireString("couchdb.url", c.CouchDB.URL)
+	switch c.CouchDB.Auth {
+	case "basic":
+	case "cookie":
+		requireString("couchdb.username", c.CouchDB.Username)
+		requireString("couchdb.password", c.CouchDB.Password)
+	case "jwt":
+		if c.CouchDB.Token == "" && c.CouchDB.TokenFile == "" {
+			errs = append(errs, "couchdb.auth jwt needs couchdb.token or couchdb.tokenfile")
+		}
+	case "proxy":
+		requireString("couchdb.username", c.CouchDB.Username)
+	default:
+		errs = append(errs, "couchdb.auth must be one of basic, cookie, jwt and proxy")
+	}
+	switch c.CouchDB.Feed {
+	case "continuous", "longpoll", "normal":
+	default:
+		errs = append(errs, "couchdb.feed must be one of continuous, longpoll and normal")
+	}
+	if c.CouchDB.Heartbeat < 0 || c.CouchDB.Timeout < 0 {
+		errs = append(errs, "couchdb.heartbeat and couchdb.timeout must not be negative")
+	}
+	if c.CouchDB.ConnectTimeout < 0 || c.CouchDB.TLSTimeout < 0 || c.CouchDB.ResponseTimeout < 0 {
+		errs = append(errs, "couchdb.connecttimeout, couchdb.tlstimeout and couchdb.responsetimeout must not be negative")
+	}
+	//longpoll responses only start once changes arrive or couchdb.timeout expires
+	if c.CouchDB.ResponseTimeout > 0 && c.CouchDB.ResponseTimeout <= c.CouchDB.Timeout {
+		errs = append(errs, "couchdb.responsetimeout must be longer than couchdb.timeout")
+	}
+	if (c.CouchDB.Cert == "") != (c.CouchDB.Key == "") {
+		errs = append(errs, "couchdb.cert and couchdb.key must be set together")
+	}
+	mysqlUsed := false
+	for _, p := range c.Pipelines {
+		mysqlUsed = mysqlUsed || c.UsesMySQL(p)
+	}
+	//mysql settings are only checked when a pipeline needs MySQL
+	if mysqlUsed {
+		requireString("mysql.host", c.MySQL.Host)
+		requirePort("mysql.port", c.MySQL.Port)
+		requireString("mysql.username", c.MySQL.Username)
+		requireString("mysql.password", c.MySQL.Password)
+		requireString("mysql.database", c.MySQL.Database)
+		requireSSH := func(key string, value *SSH) {
+			requireString(key+".host", value.Host)
+			requirePort(key+".port", value.Port)
+			requireString(key+".username", value.Username)
+			if value.Password == "" && value.KeyFile == "" && !value.Agent {
+				errs = append(errs, key+" needs one of password, keyfile and agent")
 			}
+			if value.KnownHosts == "" && value.Fingerprint == "" && !value.Insecure {
+				errs = append(errs, key+" needs knownhosts or fingerprint to verify the host key")
+			}
+		}
+		if c.MySQL.SSH != nil {
+			requireSSH("mysql.ssh", c.MySQL.SSH)
+			if c.MySQL.SSH.Keepalive < 0 {
+				errs = append(errs, "mysql.ssh.keepalive must not be negative")
+			}
+			for i := range c.MySQL.SSH.Jumps {
+				key := fmt.Sprintf("mysql.ssh.jumps[%d]", i)
+				requireSSH(key, &c.MySQL.SSH.Jumps[i])
+				if len(c.MySQL.SSH.Jumps[i].Jumps) > 0 {
+					errs = append(errs, key+" must not have jumps of its own")
+				}
+			}
+		}
+		if c.MySQL.TLS != nil {
+			switch c.MySQL.TLS.Verify {
+			case "full", "ca", "skip":
+			default:
+				errs = append(errs, "mysql.tls.verify must be one of full, ca and skip")
+			}
+			if (c.MySQL.TLS.Cert == "") != (c.MySQL.TLS.Key == "") {
+				errs = append(errs, "mysql.tls.cert and mysql.tls.key must be set together")
+			}
+		}
+	}
+	for name, p := range c.Pipelines {
+		if name != "orders" && name != "shifts" {
+			errs = append(errs, "unknown pipeline "+name)
+		}
+		if p.Batch < 1 || p.Linger < 0 {
+			errs = append(errs, "pipelines."+name+".batch must be positive and pipelines."+name+".linger must not be negative")
+		}
+		if p.Batch > 1 && (c.Sink.Type != "mysql" || p.Checkpoint.Type != "mysql" || c.DeadLetter.Type != "mysql") {
+			errs = append(errs, "pipelines."+name+".batch needs the mysql sink, the mysql checkpoint and mysql dead letters")
+		}
+		switch p.Checkpoint.Type {
+		case "mysql", "couchdb":
+		case "file":
+			requireString("pipelines."+name+".checkpoint.path", p.Checkpoint.Path)
+		default:
+			errs = append(errs, "pipelines."+name+".checkpoint.type must be one of mysql, couchdb and file")
+		}
+		if p.Filter != nil {
+			key := "pipelines." + name + ".filter"
+			switch p.Filter.Type {
+			case "_selector":
+				if len(p.Filter.Selector) == 0 || !json.Valid(p.Filter.Selector) {
+					errs = append(errs, key+".selector must be a JSON object")
+				}
+			case "_doc_ids":
+				if len(p.Filter.DocIDs) == 0 {
+					errs = append(errs, key+".docids is required")
+				}
+			case "_view":
+				if !strings.Contains(p.Filter.View, "/") {
+					errs = append(errs, key+".view must look like ddoc/view")
+				}
+			default:
+				if !strings.Contains(p.Filter.Type, "/") {
+					errs = append(errs, key+".type must be _selector, _doc_ids, _view or ddoc/filter")
+				}
+			}
+		}
+	}
+	switch c.Sink.Type {
+	case "mysql":
+	case "amqp":
+		requireString("sink.url", c.Sink.URL)
+	case "kafka":
+		if len(c.Sink.Brokers) == 0 {
+			errs = append(errs, "sink.brokers is required")
+		}
+		for name, p := range c.Pipelines {
+			if len(p.Route(c.Sink).Topic) == 0 {
+				errs = append(errs, "sink.topic or pipelines."+name+".topic is required")
+			}
+		}
+	default:
+		errs = append(errs, "sink.type must be one of mysql, amqp and kafka")
+	}
+	switch c.DeadLetter.Type {
+	case "mysql":
+	case "file":
+		requireString("deadletter.path", c.DeadLetter.Path)
+	default:
+		errs = append(errs, "deadletter.type must be one of mysql and file")
+	}
+	if c.Retry.MaxAttempts < 1 {
+		errs = append(errs, "retry.maxattempts must be at least 1")
+	}
+	if c.Retry.BaseBackoff < 0 || c.Retry.MaxBackoff < c.Retry.BaseBackoff {
+		errs = append(errs, "retry.basebackoff must not be negative or greater than retry.maxbackoff")
+	}
+	if c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+		errs = append(errs, "retry.jitter must be between 0 and 1")
+	}
+	if c.HTTP.Staleness < 0 || c.HTTP.ReadyStaleness < 0 {
+		errs = append(errs, "http.staleness and http.readystaleness must not be negative")
+	}
+	switch c.Log.Format {
+	case "json", "logfmt":
+	default:
+		errs = append(errs, "log.format must be one of json and logfmt")
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, "log.level must be one of debug, info, warn and error")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//override applies COUCH2MQ_* variables of env to tree
+func override(tree map[string]interface{}, env []string) {
+	sort.Strings(env)
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		pair := strings.SplitN(strings.TrimPrefix(kv, EnvPrefix), "=", 2)
+		if len(pair) != 2 || len(pair[0]) == 0 {
+			continue
+		}
+		key := strings.ToLower(strings.Replace(pair[0], "_", ".", -1))
+		set(tree, key, parse(tree, key, pair[1]))
+	}
+}
+
+//parse converts value to the type of the existing key, or a number for numeric keys, or JSON for objects and arrays
+func parse(tree map[string]interface{}, key string, value string) interface{} {
+	old, ok := lookup(tree, key)
+	_, isNumber := old.(float64)
+	if isNumber || (!ok && numeric[key]) {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	_, isBool := old.(bool)
+	if isBool || (!ok && boolean[key]) {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	if strings.HasPrefix(value, "{") || strings.HasPrefix(value, "[") {
+		var v interface{}
+		if json.Unmarshal([]byte(value), &v) == nil {
+			return v
+		}
+	}
+	return value
+}
+
+func lookup(tree map[string]interface{}, key string) (interface{}, bool) {
+	var node interface{} = tree
+	for _, k := range strings.Split(key, ".") {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		node, ok = m[k]
+		if !ok {
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+func set(tree map[string]interface{}, key string, value interface{}) {
+	path := strings.Split(key, ".")
+	node := tree
+	for _, k := range path[:len(path)-1] {
+		next, ok := node[k].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			node[k] = next
 		}
-		return err
+		node = next
 	}
-	return err
+	node[path[len(path)-1]] = value
 }
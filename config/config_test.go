@@ -0,0 +1,167 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOverride(t *testing.T) {
+	tests := []struct {
+		name string
+		tree string
+		env  string
+		key  string
+		want interface{}
+	}{
+		{"string", `{"mysql":{"host":"db"}}`, "COUCH2MQ_MYSQL_HOST=db2", "mysql.host", "db2"},
+		{"existing number", `{"mysql":{"port":3306}}`, "COUCH2MQ_MYSQL_PORT=3307", "mysql.port", float64(3307)},
+		{"numeric key", `{}`, "COUCH2MQ_MYSQL_PORT=3307", "mysql.port", float64(3307)},
+		{"numeric key without number", `{}`, "COUCH2MQ_MYSQL_PORT=default", "mysql.port", "default"},
+		{"string key with number", `{}`, "COUCH2MQ_MYSQL_PASSWORD=1234", "mysql.password", "1234"},
+		{"existing bool", `{"couchdb":{"insecure":false}}`, "COUCH2MQ_COUCHDB_INSECURE=true", "couchdb.insecure", true},
+		{"boolean key", `{}`, "COUCH2MQ_MYSQL_SSH_AGENT=1", "mysql.ssh.agent", true},
+		{"nested ssh", `{"mysql":{"host":"db"}}`, "COUCH2MQ_MYSQL_SSH_PASSWORD=secret", "mysql.ssh.password", "secret"},
+		{"nested ssh number", `{"mysql":{"ssh":{"host":"bastion"}}}`, "COUCH2MQ_MYSQL_SSH_PORT=2222", "mysql.ssh.port", float64(2222)},
+		{"json array", `{}`, `COUCH2MQ_SINK_BROKERS=["k1:9092","k2:9092"]`, "sink.brokers", []interface{}{"k1:9092", "k2:9092"}},
+		{"json object", `{}`, `COUCH2MQ_PIPELINES_ORDERS_FILTER={"type":"_doc_ids"}`, "pipelines.orders.filter", map[string]interface{}{"type": "_doc_ids"}},
+	}
+	for _, tt := range tests {
+		tree := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(tt.tree), &tree); err != nil {
+			t.Fatal(err)
+		}
+		override(tree, []string{"PATH=/bin", "COUCH2MQ_=ignored", tt.env})
+		got, ok := lookup(tree, tt.key)
+		if !ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %s is %#v, want %#v", tt.name, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestOverrideKeepsSiblings(t *testing.T) {
+	tree := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(`{"mysql":{"host":"db","ssh":{"host":"bastion","port":22}}}`), &tree); err != nil {
+		t.Fatal(err)
+	}
+	override(tree, []string{"COUCH2MQ_MYSQL_SSH_USERNAME=tunnel"})
+	for key, want := range map[string]interface{}{
+		"mysql.host":         "db",
+		"mysql.ssh.host":     "bastion",
+		"mysql.ssh.port":     float64(22),
+		"mysql.ssh.username": "tunnel",
+	} {
+		if got, _ := lookup(tree, key); got != want {
+			t.Errorf("%s is %#v, want %#v", key, got, want)
+		}
+	}
+}
+
+func TestLoadWithEnvironment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conf.json")
+	conf := `{
+  "couchdb": {"url": "http://couchdb:5984"},
+  "mysql": {"host": "db", "username": "oc", "password": "pw", "database": "oc"}
+}`
+	if err := ioutil.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("COUCH2MQ_MYSQL_PORT", "3307")
+	t.Setenv("COUCH2MQ_MYSQL_SSH_HOST", "bastion")
+	t.Setenv("COUCH2MQ_MYSQL_SSH_USERNAME", "tunnel")
+	t.Setenv("COUCH2MQ_MYSQL_SSH_AGENT", "true")
+	t.Setenv("COUCH2MQ_MYSQL_SSH_INSECURE", "true")
+	t.Setenv("COUCH2MQ_MYSQL_SSH_KEEPALIVE", "5000")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MySQL.Port != 3307 {
+		t.Errorf("mysql.port is %d", cfg.MySQL.Port)
+	}
+	want := SSH{Host: "bastion", Port: 22, Username: "tunnel", Agent: true, Insecure: true, Keepalive: 5000}
+	if cfg.MySQL.SSH == nil || !reflect.DeepEqual(*cfg.MySQL.SSH, want) {
+		t.Errorf("mysql.ssh is %+v, want %+v", cfg.MySQL.SSH, want)
+	}
+}
+
+func validConfig() *Config {
+	cfg := Default()
+	cfg.CouchDB.URL = "http://couchdb:5984"
+	cfg.MySQL.Host = "db"
+	cfg.MySQL.Username = "oc"
+	cfg.MySQL.Password = "pw"
+	cfg.MySQL.Database = "oc"
+	cfg.fill()
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("valid configuration rejected: %v", err)
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	cfg := validConfig()
+	cfg.CouchDB.URL = ""
+	cfg.CouchDB.Feed = "stream"
+	cfg.MySQL.Port = 0
+	cfg.MySQL.SSH = &SSH{Host: "bastion", Port: 22, Username: "tunnel"}
+	cfg.Retry.Jitter = 2
+	cfg.Log.Format = "xml"
+	cfg.Pipelines["refunds"] = Pipeline{Database: "refunds", Batch: 1, Checkpoint: Checkpoint{Type: "file"}}
+	err := cfg.Validate()
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("Validate returned %#v, want Errors", err)
+	}
+	want := []string{
+		"couchdb.url is required",
+		"couchdb.feed must be one of continuous, longpoll and normal",
+		"mysql.port 0 is not a valid port",
+		"mysql.ssh needs one of password, keyfile and agent",
+		"mysql.ssh needs knownhosts or fingerprint to verify the host key",
+		"unknown pipeline refunds",
+		"pipelines.refunds.checkpoint.path is required",
+		"retry.jitter must be between 0 and 1",
+		"log.format must be one of json and logfmt",
+	}
+	if !reflect.DeepEqual([]string(errs), want) {
+		t.Errorf("Validate reported\n%q\nwant\n%q", errs, want)
+	}
+}
+
+func TestValidateWithoutMySQL(t *testing.T) {
+	cfg := Default()
+	cfg.CouchDB.URL = "http://couchdb:5984"
+	cfg.Sink = Sink{Type: "kafka", Brokers: []string{"k1:9092"}, Topic: "orders"}
+	cfg.Pipelines = map[string]Pipeline{"orders": {Checkpoint: Checkpoint{Type: "couchdb"}}}
+	cfg.fill()
+	if cfg.DeadLetter.Type != "file" || cfg.DeadLetter.Path != "deadletters" {
+		t.Errorf("deadletter is %+v, want the file type", cfg.DeadLetter)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("configuration without MySQL rejected: %v", err)
+	}
+	//dead letters kept in MySQL need the connection settings again
+	cfg.DeadLetter.Type = "mysql"
+	errs, _ := cfg.Validate().(Errors)
+	if len(errs) == 0 || errs[0] != "mysql.host is required" {
+		t.Errorf("Validate reported %q, want mysql settings", errs)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	s := Sink{Type: "kafka", Exchange: "oc", RoutingKey: "", Topic: "orders"}
+	got := Pipeline{Topic: "shifts", RoutingKey: "shift"}.Route(s)
+	want := Sink{Type: "kafka", Exchange: "oc", RoutingKey: "shift", Topic: "shifts"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Route is %+v, want %+v", got, want)
+	}
+	if got = (Pipeline{}).Route(s); !reflect.DeepEqual(got, s) {
+		t.Errorf("Route without overrides is %+v, want %+v", got, s)
+	}
+}
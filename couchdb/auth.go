@@ -0,0 +1,155 @@
+package couchdb
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+//Authenticator adds credentials to requests sent to CouchDB
+type Authenticator interface {
+	Authenticate(c *Client, req *http.Request) error
+}
+
+//Renewer is implemented by authenticators whose credentials expire, Renew is called once when a request gets 401
+type Renewer interface {
+	Renew(c *Client) error
+}
+
+//BasicAuth sends the user name and password with every request
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+//Authenticate see Authenticator
+func (a *BasicAuth) Authenticate(c *Client, req *http.Request) error {
+	req.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+//CookieAuth logs in at _session and sends the AuthSession cookie, the session is renewed when it expires
+type CookieAuth struct {
+	Username string
+	Password string
+	mu       sync.Mutex
+	cookie   *http.Cookie
+}
+
+//Authenticate see Authenticator
+func (a *CookieAuth) Authenticate(c *Client, req *http.Request) error {
+	a.mu.Lock()
+	cookie := a.cookie
+	a.mu.Unlock()
+	if cookie == nil {
+		err := a.Renew(c)
+		if err != nil {
+			return err
+		}
+		a.mu.Lock()
+		cookie = a.cookie
+		a.mu.Unlock()
+	}
+	//a retried request still carries the expired cookie
+	req.Header.Del("Cookie")
+	req.AddCookie(cookie)
+	return nil
+}
+
+//Renew see Renewer
+func (a *CookieAuth) Renew(c *Client) error {
+	r, err := url.Parse("/_session")
+	if err == nil {
+		form := url.Values{"name": {a.Username}, "password": {a.Password}}
+		var req *http.Request
+		req, err = http.NewRequest("POST", c.URL.ResolveReference(r).String(), strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			var resp *http.Response
+			resp, err = c.HTTP.Do(req)
+			if err == nil {
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					return newHTTPError(resp)
+				}
+				for _, cookie := range resp.Cookies() {
+					if cookie.Name == "AuthSession" {
+						a.mu.Lock()
+						a.cookie = &http.Cookie{Name: cookie.Name, Value: cookie.Value}
+						a.mu.Unlock()
+						c.Logger.Info("session renewed", "user", a.Username)
+						return nil
+					}
+				}
+				return errors.New("couchdb: _session returned no AuthSession cookie")
+			}
+		}
+	}
+	return err
+}
+
+//JWTAuth sends a bearer token, the token is read from File when it is set and reread when it is rejected
+type JWTAuth struct {
+	Token string
+	File  string
+	mu    sync.Mutex
+}
+
+//Authenticate see Authenticator
+func (a *JWTAuth) Authenticate(c *Client, req *http.Request) error {
+	a.mu.Lock()
+	token := a.Token
+	a.mu.Unlock()
+	if len(token) == 0 && len(a.File) > 0 {
+		err := a.Renew(c)
+		if err != nil {
+			return err
+		}
+		a.mu.Lock()
+		token = a.Token
+		a.mu.Unlock()
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+//Renew see Renewer
+func (a *JWTAuth) Renew(c *Client) error {
+	if len(a.File) == 0 {
+		return errors.New("couchdb: jwt token rejected")
+	}
+	b, err := ioutil.ReadFile(a.File)
+	if err == nil {
+		a.mu.Lock()
+		a.Token = strings.TrimSpace(string(b))
+		a.mu.Unlock()
+		return nil
+	}
+	return err
+}
+
+//ProxyAuth sends the X-Auth-CouchDB-* headers expected by proxy authentication,
+//the token is signed with Secret when it is set
+type ProxyAuth struct {
+	Username string
+	Roles    []string
+	Secret   string
+}
+
+//Authenticate see Authenticator
+func (a *ProxyAuth) Authenticate(c *Client, req *http.Request) error {
+	req.Header.Set("X-Auth-CouchDB-UserName", a.Username)
+	req.Header.Set("X-Auth-CouchDB-Roles", strings.Join(a.Roles, ","))
+	if len(a.Secret) > 0 {
+		mac := hmac.New(sha1.New, []byte(a.Secret))
+		mac.Write([]byte(a.Username))
+		req.Header.Set("X-Auth-CouchDB-Token", hex.EncodeToString(mac.Sum(nil)))
+	}
+	return nil
+}
@@ -2,42 +2,255 @@ package couchdb
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"time"
 )
 
 //Client holds basic information of CouchDB
 type Client struct {
-	Username string
-	Password string
-	URL      *url.URL
+	//Auth is nil when CouchDB is accessed anonymously
+	Auth   Authenticator
+	URL    *url.URL
+	Logger *slog.Logger
+	//HTTP is shared by all requests so that connections are reused
+	HTTP *http.Client
+}
+
+//Options configures the transport of Client, zero values keep the defaults
+type Options struct {
+	//CA is a PEM bundle of trusted roots, system roots are used when it is empty
+	CA string
+	//Cert and Key are the PEM client certificate and its key
+	Cert string
+	Key  string
+	//ServerName overrides the host name checked in the server certificate
+	ServerName string
+	//Insecure skips verification of the server certificate
+	Insecure bool
+	//Proxy is the URL of the HTTP proxy, HTTP_PROXY and friends are used when it is empty
+	Proxy string
+	//ConnectTimeout, TLSTimeout and ResponseTimeout bound dialing, the TLS handshake and waiting for response headers,
+	//there is no timeout on whole requests since continuous feeds never end
+	ConnectTimeout  time.Duration
+	TLSTimeout      time.Duration
+	ResponseTimeout time.Duration
+}
+
+//Transport builds the http transport described by options
+func (o Options) Transport() (*http.Transport, error) {
+	cfg := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.Insecure,
+	}
+	if len(o.CA) > 0 {
+		pem, err := ioutil.ReadFile(o.CA)
+		if err != nil {
+			return nil, fmt.Errorf("couchdb ca %s: %v", o.CA, err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("couchdb ca %s: no certificate found", o.CA)
+		}
+	}
+	if len(o.Cert) > 0 || len(o.Key) > 0 {
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, fmt.Errorf("couchdb client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	proxy := http.ProxyFromEnvironment
+	if len(o.Proxy) > 0 {
+		u, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("couchdb proxy %s: %v", o.Proxy, err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	dialer := &net.Dialer{
+		Timeout:   o.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	t := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       cfg,
+		TLSHandshakeTimeout:   o.TLSTimeout,
+		ResponseHeaderTimeout: o.ResponseTimeout,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return t, nil
+}
+
+//HTTPError is returned when CouchDB responds with an unexpected status
+type HTTPError struct {
+	StatusCode int
+	Response   string
+}
+
+func newHTTPError(resp *http.Response) *HTTPError {
+	b, _ := httputil.DumpResponse(resp, true)
+	return &HTTPError{
+		StatusCode: resp.StatusCode,
+		Response:   string(b[:]),
+	}
+}
+
+func (e *HTTPError) Error() string {
+	return e.Response
 }
 
 //DB holds information of a database in CouchDB instance
 type DB struct {
 	client *Client
+	ctx    context.Context
+	filter *Filter
 	Name   string
 }
 
+//Filter restricts change feeds to relevant documents,
+//Type is _selector, _doc_ids, _view or a design filter like ddoc/name
+type Filter struct {
+	Type string
+	//Selector is a Mango selector used by _selector
+	Selector json.RawMessage
+	//DocIDs are the documents followed by _doc_ids
+	DocIDs []string
+	//View is ddoc/view used by _view
+	View string
+	//Params are passed to design filters as query parameters
+	Params map[string]string
+}
+
+//body returns the JSON body of filters which are sent by POST, nil for the others
+func (f *Filter) body() ([]byte, error) {
+	if f == nil {
+		return nil, nil
+	}
+	switch f.Type {
+	case "_selector":
+		return json.Marshal(map[string]json.RawMessage{"selector": f.Selector})
+	case "_doc_ids":
+		return json.Marshal(map[string][]string{"doc_ids": f.DocIDs})
+	}
+	return nil, nil
+}
+
+//WithFilter returns a copy of the database whose change feeds are filtered by f
+func (d *DB) WithFilter(f *Filter) *DB {
+	db := *d
+	db.filter = f
+	return &db
+}
+
+//WithContext returns a copy of the database whose requests are canceled with ctx
+func (d *DB) WithContext(ctx context.Context) *DB {
+	db := *d
+	db.ctx = ctx
+	return &db
+}
+
+func (d *DB) newRequest(method string, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err == nil && d.ctx != nil {
+		return req.WithContext(d.ctx), nil
+	}
+	return req, err
+}
+
 //New returns a new instance of Client
-func New(rawurl string, username string, password string) (*Client, error) {
+func New(rawurl string, auth Authenticator, opts Options) (*Client, error) {
 	u, err := url.Parse(rawurl)
 	if err == nil {
-		client := Client{
-			Username: username,
-			Password: password,
-			URL:      u,
+		var t *http.Transport
+		t, err = opts.Transport()
+		if err == nil {
+			client := Client{
+				Auth:   auth,
+				URL:    u,
+				Logger: slog.Default().With("component", "couchdb"),
+				HTTP:   &http.Client{Transport: t},
+			}
+			return &client, nil
+		}
+	}
+	return nil, err
+}
+
+//send authenticates req and sends it with the shared client
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	if c.Auth != nil {
+		err := c.Auth.Authenticate(c, req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.HTTP.Do(req)
+}
+
+//retry renews expired credentials and sends a copy of req again
+func (c *Client) retry(req *http.Request) (*http.Response, error) {
+	err := c.Auth.(Renewer).Renew(c)
+	if err == nil {
+		again := req.Clone(req.Context())
+		if req.GetBody != nil {
+			again.Body, err = req.GetBody()
 		}
-		return &client, nil
+		if err == nil {
+			return c.send(again)
+		}
+	}
+	return nil, err
+}
+
+//do sends req, retries once with renewed credentials on 401 and logs the outcome
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := c.send(req)
+	if _, ok := c.Auth.(Renewer); ok && err == nil && resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		resp, err = c.retry(req)
+	}
+	if err == nil {
+		c.Logger.Debug("request", "method", req.Method, "path", req.URL.Path, "status", resp.StatusCode, "duration", time.Since(start))
+		return resp, nil
 	}
+	c.Logger.Warn("request failed", "method", req.Method, "path", req.URL.Path, "duration", time.Since(start), "error", err)
 	return nil, err
 }
 
+//Ping returns nil when the CouchDB instance answers its root endpoint within 10 seconds
+func (c *Client) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", c.URL.String(), nil)
+	if err == nil {
+		resp, err := c.do(req)
+		if err == nil {
+			defer resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			return newHTTPError(resp)
+		}
+		return err
+	}
+	return err
+}
+
 //DB returns a database in a given CouchDB instance
 func (c *Client) DB(name string) (*DB, error) {
 	r, err := url.Parse(name)
@@ -51,6 +264,66 @@ func (c *Client) DB(name string) (*DB, error) {
 	return nil, err
 }
 
+//docURL returns the URL of the document id
+func (d *DB) docURL(id string) (string, error) {
+	r, err := url.Parse(d.Name + "/" + id)
+	if err == nil {
+		return d.client.URL.ResolveReference(r).String(), nil
+	}
+	return "", err
+}
+
+//Get reads the document id into v, a missing document is an HTTPError with status 404
+func (d *DB) Get(id string, v interface{}) error {
+	u, err := d.docURL(id)
+	if err == nil {
+		req, err := d.newRequest("GET", u, nil)
+		if err == nil {
+			resp, err := d.client.do(req)
+			if err == nil {
+				defer resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					return json.NewDecoder(resp.Body).Decode(v)
+				}
+				return newHTTPError(resp)
+			}
+			return err
+		}
+		return err
+	}
+	return err
+}
+
+//Put writes v as the document id and returns its new revision, v must carry _rev when the document exists
+func (d *DB) Put(id string, v interface{}) (string, error) {
+	u, err := d.docURL(id)
+	if err == nil {
+		body, err := json.Marshal(v)
+		if err == nil {
+			req, err := d.newRequest("PUT", u, bytes.NewReader(body))
+			if err == nil {
+				req.Header.Set("Content-Type", "application/json")
+				resp, err := d.client.do(req)
+				if err == nil {
+					defer resp.Body.Close()
+					if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusAccepted {
+						var result struct {
+							Rev string `json:"rev"`
+						}
+						err = json.NewDecoder(resp.Body).Decode(&result)
+						return result.Rev, err
+					}
+					return "", newHTTPError(resp)
+				}
+				return "", err
+			}
+			return "", err
+		}
+		return "", err
+	}
+	return "", err
+}
+
 // Sequence represents update sequence ID. It is string in 2.0, integer in previous versions.
 // Use a new type to attach a customized unmarshaler
 // code borrowed from kivik
@@ -76,44 +349,87 @@ type Change struct {
 	Doc       json.RawMessage `json:"doc"`
 }
 
+//Rev returns the winning revision of the change
+func (c *Change) Rev() string {
+	if len(c.Revisions) > 0 {
+		return c.Revisions[0].Revison
+	}
+	return ""
+}
+
 //IChanges is the interface to iterate over changes
 type IChanges interface {
 	Next() bool
 	Get() (*Change, error)
+	Close() error
 }
 
-//Changes represents the result of CouchDB changes of 'normal' mode
+//Changes represents the result of CouchDB changes of 'normal' and 'longpoll' mode
 type Changes struct {
 	index   int      `json:"-"`
 	Results []Change `json:"results"`
-	LastReq string   `json:"last_seq"`
+	LastReq Sequence `json:"last_seq"`
 	Pending uint     `json:"pending"`
 }
 
 //Next returns true when there is data
 func (c *Changes) Next() bool {
-	c.index++
-	return c.index < len(c.Results)
+	if c.index < len(c.Results) {
+		c.index++
+		return true
+	}
+	return false
 }
 
 //Get return the current data
 func (c *Changes) Get() (*Change, error) {
-	if c.index < len(c.Results) {
-		return &c.Results[c.index], nil
+	if c.index > 0 && c.index <= len(c.Results) {
+		return &c.Results[c.index-1], nil
 	}
-	return nil, errors.New("There is no more change feeds")
+	return nil, io.EOF
+}
+
+//Close does nothing since the whole response has been read
+func (c *Changes) Close() error {
+	return nil
 }
 
 //ConChanges represents the result stream of a continuous change feeds
 type ConChanges struct {
+	body    io.ReadCloser
 	decoder *json.Decoder
+	idle    *time.Timer
 	err     error
 	change  Change
+	LastSeq Sequence
+	Pending uint
+	//OnRead is called whenever data or a heartbeat arrives
+	OnRead func()
+}
+
+//conLine is one line of continuous feeds, the last line only carries last_seq and pending
+type conLine struct {
+	Change
+	LastSeq Sequence `json:"last_seq"`
+	Pending uint     `json:"pending"`
 }
 
 //Next return true when there is more feeds to come
 func (c *ConChanges) Next() bool {
-	c.err = c.decoder.Decode(&c.change)
+	if c.err != nil {
+		return false
+	}
+	var line conLine
+	c.err = c.decoder.Decode(&line)
+	if c.err == nil {
+		if len(line.ID) == 0 && len(line.LastSeq) > 0 {
+			c.LastSeq = line.LastSeq
+			c.Pending = line.Pending
+			c.err = io.EOF
+			return false
+		}
+		c.change = line.Change
+	}
 	return c.err == nil
 }
 
@@ -125,96 +441,164 @@ func (c *ConChanges) Get() (*Change, error) {
 	return nil, c.err
 }
 
-//ContinuousChanges returns a continous change feeds
-func (d *DB) ContinuousChanges(since string) (*ConChanges, error) {
+//Close closes the underlying stream
+func (c *ConChanges) Close() error {
+	if c.idle != nil {
+		c.idle.Stop()
+	}
+	return c.body.Close()
+}
+
+//idleReader closes the stream when nothing, not even a heartbeat, arrives in time
+type idleReader struct {
+	body    io.ReadCloser
+	idle    *time.Timer
+	timeout time.Duration
+	changes *ConChanges
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		r.idle.Reset(r.timeout)
+		if r.changes.OnRead != nil {
+			r.changes.OnRead()
+		}
+	}
+	return n, err
+}
+
+func (d *DB) changesURL(feed string, since string, params map[string]string) (string, error) {
 	r, err := url.Parse(d.Name + "/_changes")
 	if err == nil {
 		u := d.client.URL.ResolveReference(r)
 		q := u.Query()
-		q.Set("feed", "continuous")
+		q.Set("feed", feed)
 		q.Set("conflicts", "true")
 		q.Set("include_docs", "true")
+		for k, v := range params {
+			q.Set(k, v)
+		}
+		if d.filter != nil {
+			q.Set("filter", d.filter.Type)
+			if d.filter.Type == "_view" {
+				q.Set("view", d.filter.View)
+			}
+			for k, v := range d.filter.Params {
+				q.Set(k, v)
+			}
+		}
 		if len(since) > 0 {
 			q.Set("since", since)
 		}
 		u.RawQuery = q.Encode()
-		req, err := http.NewRequest("GET", u.String(), nil)
-		//		b, err := httputil.DumpRequestOut(req, true)
-		//		pretty.Println(string(b), err)
+		return u.String(), nil
+	}
+	return "", err
+}
+
+//changesRequest builds the request of change feeds, filters with a body are sent by POST
+func (d *DB) changesRequest(feed string, since string, params map[string]string) (*http.Request, error) {
+	u, err := d.changesURL(feed, since, params)
+	if err == nil {
+		var body []byte
+		body, err = d.filter.body()
 		if err == nil {
-			if len(d.client.Username) > 0 {
-				req.SetBasicAuth(d.client.Username, d.client.Password)
+			if body == nil {
+				return d.newRequest("GET", u, nil)
 			}
-			cli := &http.Client{}
-
-			resp, err := cli.Do(req)
+			var req *http.Request
+			req, err = d.newRequest("POST", u, bytes.NewReader(body))
 			if err == nil {
-				defer resp.Body.Close()
-				if resp.Status == "200 OK" {
-					ch := ConChanges{
-						decoder: json.NewDecoder(resp.Body),
-					}
+				req.Header.Set("Content-Type", "application/json")
+				return req, nil
+			}
+		}
+	}
+	return nil, err
+}
 
-					return &ch, nil
+//ContinuousChanges returns a continous change feeds, heartbeat and timeout are in milliseconds.
+//The stream is closed when nothing arrives within twice the heartbeat, or twice the timeout when there is no heartbeat.
+func (d *DB) ContinuousChanges(since string, heartbeat int, timeout int) (*ConChanges, error) {
+	params := make(map[string]string)
+	if heartbeat > 0 {
+		params["heartbeat"] = strconv.Itoa(heartbeat)
+	}
+	if timeout > 0 {
+		params["timeout"] = strconv.Itoa(timeout)
+	}
+	req, err := d.changesRequest("continuous", since, params)
+	if err == nil {
+		resp, err := d.client.do(req)
+		if err == nil {
+			if resp.StatusCode == http.StatusOK {
+				ch := &ConChanges{
+					body: resp.Body,
 				}
-
-				b, _ := httputil.DumpResponse(resp, true)
-				return nil, errors.New(string(b[:]))
+				interval := heartbeat
+				if interval <= 0 {
+					interval = timeout
+				}
+				if interval > 0 {
+					wait := 2 * time.Duration(interval) * time.Millisecond
+					ch.idle = time.AfterFunc(wait, func() {
+						resp.Body.Close()
+					})
+					ch.decoder = json.NewDecoder(&idleReader{
+						body:    resp.Body,
+						idle:    ch.idle,
+						timeout: wait,
+						changes: ch,
+					})
+				} else {
+					ch.decoder = json.NewDecoder(resp.Body)
+				}
+				return ch, nil
 			}
+			defer resp.Body.Close()
+			return nil, newHTTPError(resp)
 		}
+		return nil, err
 	}
 	return nil, err
-
 }
 
-//NormalChanges returns 100 feeds along with docs and conflicts
-func (d *DB) NormalChanges(since string) (*Changes, error) {
-	r, err := url.Parse(d.Name + "/_changes")
+func (d *DB) changes(feed string, since string, params map[string]string) (*Changes, error) {
+	req, err := d.changesRequest(feed, since, params)
 	if err == nil {
-		u := d.client.URL.ResolveReference(r)
-		q := u.Query()
-		q.Set("feed", "normal")
-		q.Set("conflicts", "true")
-		q.Set("include_docs", "true")
-		q.Set("limit", "100")
-		if len(since) > 0 {
-			q.Set("since", since)
-		}
-		u.RawQuery = q.Encode()
-		req, err := http.NewRequest("GET", u.String(), nil)
-		//		b, err := httputil.DumpRequestOut(req, true)
-		//		pretty.Println(string(b), err)
+		resp, err := d.client.do(req)
 		if err == nil {
-			if len(d.client.Username) > 0 {
-				req.SetBasicAuth(d.client.Username, d.client.Password)
-			}
-			cli := &http.Client{
-				Transport: &http.Transport{
-					TLSClientConfig: &tls.Config{
-						InsecureSkipVerify: true,
-					},
-				},
-			}
-			resp, err := cli.Do(req)
-			if err == nil {
-				if resp.Status == "200 OK" {
-					data, err := ioutil.ReadAll(resp.Body)
+			defer resp.Body.Close()
+			if resp.Status == "200 OK" {
+				data, err := ioutil.ReadAll(resp.Body)
+				if err == nil {
+					ch := Changes{}
+					err = json.Unmarshal(data, &ch)
 					if err == nil {
-						ch := Changes{}
-						err = json.Unmarshal(data, &ch)
-						if err == nil {
-							return &ch, nil
-						}
-						return nil, err
+						return &ch, nil
 					}
 					return nil, err
 				}
-				b, _ := httputil.DumpResponse(resp, true)
-				return nil, errors.New(string(b[:]))
+				return nil, err
 			}
-			return nil, err
+			return nil, newHTTPError(resp)
 		}
 		return nil, err
 	}
 	return nil, err
 }
+
+//NormalChanges returns 100 feeds along with docs and conflicts
+func (d *DB) NormalChanges(since string) (*Changes, error) {
+	return d.changes("normal", since, map[string]string{"limit": "100"})
+}
+
+//LongpollChanges waits up to timeout milliseconds for changes and returns at most 100 feeds
+func (d *DB) LongpollChanges(since string, timeout int) (*Changes, error) {
+	params := map[string]string{"limit": "100"}
+	if timeout > 0 {
+		params["timeout"] = strconv.Itoa(timeout)
+	}
+	return d.changes("longpoll", since, params)
+}
@@ -0,0 +1,210 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+//feedServer serves lines as a continuous feed, flushing after each of them, and then hangs when hang is set
+func feedServer(t *testing.T, lines []string, hang bool) *DB {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/orders/_changes" || r.URL.Query().Get("feed") != "continuous" {
+			http.NotFound(w, r)
+			return
+		}
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+			w.(http.Flusher).Flush()
+		}
+		if hang {
+			<-r.Context().Done()
+		}
+	}))
+	t.Cleanup(server.Close)
+	client, err := New(server.URL, nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := client.DB("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestContinuousChanges(t *testing.T) {
+	db := feedServer(t, []string{
+		`{"seq":"1-g1AAAA","id":"order-1","changes":[{"rev":"1-a"}],"doc":{"_id":"order-1"}}`,
+		``,
+		``,
+		`{"seq":2,"id":"order-2","changes":[{"rev":"3-c"},{"rev":"2-b"}],"doc":{"_id":"order-2","_deleted":true}}`,
+		``,
+		`{"last_seq":"2-g1AAAB","pending":7}`,
+	}, false)
+	ch, err := db.ContinuousChanges("", 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	reads := 0
+	ch.OnRead = func() {
+		reads++
+	}
+	var got []string
+	for ch.Next() {
+		c, err := ch.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %s %s", c.Seq, c.ID, c.Rev()))
+	}
+	want := []string{"1-g1AAAA order-1 1-a", "2 order-2 3-c"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("changes are %q, want %q", got, want)
+	}
+	if _, err = ch.Get(); err != io.EOF {
+		t.Errorf("Get after the last_seq row returned %v, want EOF", err)
+	}
+	if ch.LastSeq != "2-g1AAAB" || ch.Pending != 7 {
+		t.Errorf("last_seq %q pending %d, want 2-g1AAAB and 7", ch.LastSeq, ch.Pending)
+	}
+	if reads == 0 {
+		t.Error("OnRead was not called")
+	}
+}
+
+func TestContinuousChangesIdle(t *testing.T) {
+	//without heartbeats the stream is watched with the timeout
+	for _, ms := range [][2]int{{20, 0}, {0, 20}} {
+		db := feedServer(t, []string{
+			`{"seq":"1-a","id":"order-1","changes":[{"rev":"1-a"}]}`,
+		}, true)
+		ch, err := db.ContinuousChanges("", ms[0], ms[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan int)
+		go func() {
+			n := 0
+			for ch.Next() {
+				n++
+			}
+			done <- n
+		}()
+		select {
+		case n := <-done:
+			if n != 1 {
+				t.Errorf("heartbeat %d timeout %d: %d changes, want 1", ms[0], ms[1], n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("heartbeat %d timeout %d: the idle feed was not closed", ms[0], ms[1])
+		}
+		_, err = ch.Get()
+		if err == nil || err == io.EOF {
+			t.Errorf("heartbeat %d timeout %d: Get of an idle feed returned %v, want a read error", ms[0], ms[1], err)
+		}
+		if len(ch.LastSeq) > 0 {
+			t.Errorf("heartbeat %d timeout %d: an interrupted feed reported last_seq %q", ms[0], ms[1], ch.LastSeq)
+		}
+		ch.Close()
+	}
+}
+
+func TestNormalChanges(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("feed") != "normal" || q.Get("since") != "5-e" || q.Get("limit") != "100" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `{"results":[{"seq":"6-f","id":"order-6","changes":[{"rev":"1-a"}]}],"last_seq":"6-f","pending":0}`)
+	}))
+	defer server.Close()
+	client, err := New(server.URL, nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := client.DB("orders")
+	ch, err := db.NormalChanges("5-e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ch.Next() {
+		t.Fatal("no change")
+	}
+	if c, _ := ch.Get(); c.ID != "order-6" {
+		t.Errorf("change of %s, want order-6", c.ID)
+	}
+	if ch.Next() {
+		t.Error("more than one change")
+	}
+	if ch.LastReq != "6-f" {
+		t.Errorf("last_seq is %q, want 6-f", ch.LastReq)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter *Filter
+		method string
+		query  map[string]string
+		body   string
+	}{
+		{"none", nil, "GET", map[string]string{"filter": ""}, ""},
+		{"selector", &Filter{Type: "_selector", Selector: json.RawMessage(`{"type":"order"}`)},
+			"POST", map[string]string{"filter": "_selector"}, `{"selector":{"type":"order"}}`},
+		{"doc ids", &Filter{Type: "_doc_ids", DocIDs: []string{"order-1", "order-2"}},
+			"POST", map[string]string{"filter": "_doc_ids"}, `{"doc_ids":["order-1","order-2"]}`},
+		{"view", &Filter{Type: "_view", View: "orders/by_shop"},
+			"GET", map[string]string{"filter": "_view", "view": "orders/by_shop"}, ""},
+		{"design filter", &Filter{Type: "orders/paid", Params: map[string]string{"shop": "s1"}},
+			"GET", map[string]string{"filter": "orders/paid", "shop": "s1"}, ""},
+	}
+	for _, tt := range tests {
+		var method, body, contentType string
+		var query url.Values
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method = r.Method
+			query = r.URL.Query()
+			contentType = r.Header.Get("Content-Type")
+			b, _ := ioutil.ReadAll(r.Body)
+			body = string(b)
+			fmt.Fprint(w, `{"results":[],"last_seq":"9-z","pending":0}`)
+		}))
+		client, err := New(server.URL, nil, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, _ := client.DB("orders")
+		_, err = db.WithFilter(tt.filter).LongpollChanges("5-e", 1000)
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if method != tt.method {
+			t.Errorf("%s: sent by %s, want %s", tt.name, method, tt.method)
+		}
+		for k, v := range tt.query {
+			if query.Get(k) != v {
+				t.Errorf("%s: query %s is %q, want %q", tt.name, k, query.Get(k), v)
+			}
+		}
+		if query.Get("since") != "5-e" || query.Get("feed") != "longpoll" {
+			t.Errorf("%s: unexpected query %s", tt.name, query.Encode())
+		}
+		if body != tt.body {
+			t.Errorf("%s: body is %q, want %q", tt.name, body, tt.body)
+		}
+		if tt.method == "POST" && contentType != "application/json" {
+			t.Errorf("%s: content type is %q", tt.name, contentType)
+		}
+	}
+}
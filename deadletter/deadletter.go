@@ -0,0 +1,168 @@
+package deadletter
+
+import (
+	"couch2mq/couchdb"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const createTable = `CREATE TABLE IF NOT EXISTS dead_letter (
+  id int(11) NOT NULL AUTO_INCREMENT,
+  pipeline varchar(50) NOT NULL,
+  docid varchar(255) NOT NULL,
+  rev varchar(255) NOT NULL DEFAULT '',
+  seq varchar(2048) NOT NULL,
+  doc longtext,
+  error varchar(2048) DEFAULT NULL,
+  attempts int(11) NOT NULL DEFAULT '1',
+  createTime datetime DEFAULT CURRENT_TIMESTAMP,
+  updateTime datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (id),
+  UNIQUE KEY pipeline_doc_rev (pipeline, docid, rev)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+//Letter is a change which failed to apply
+type Letter struct {
+	ID       int    `json:"id"`
+	Pipeline string `json:"pipeline"`
+	DocID    string `json:"docid"`
+	Rev      string `json:"rev"`
+	Seq      string `json:"seq"`
+	Doc      string `json:"doc"`
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+}
+
+//Change rebuilds the CouchDB change of a letter
+func (l *Letter) Change() *couchdb.Change {
+	return &couchdb.Change{
+		Seq:       couchdb.Sequence(l.Seq),
+		ID:        l.DocID,
+		Revisions: []couchdb.Rev{{Revison: l.Rev}},
+		Doc:       []byte(l.Doc),
+	}
+}
+
+//Letters keeps changes which failed to apply, Store keeps them in MySQL and File in a directory
+type Letters interface {
+	//Put records a failed change, a failed revision recorded before gets its attempts increased
+	Put(pipeline string, change *couchdb.Change, inerr error) error
+	//List returns dead letters with given ids, or all of them when ids is empty
+	List(ids []int) ([]Letter, error)
+	//Resolve removes a dead letter which has been applied
+	Resolve(id int) error
+	//Retry records another failed attempt of a dead letter
+	Retry(id int, inerr error) error
+}
+
+//querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+//Store holds dead letters in MySQL
+type Store struct {
+	db querier
+}
+
+//WithTx returns a copy of the store whose statements run in tx
+func (s *Store) WithTx(tx *sql.Tx) *Store {
+	return &Store{db: tx}
+}
+
+//New returns a store and creates dead_letter table if it does not exist
+func New(db *sql.DB) (*Store, error) {
+	_, err := db.Exec(createTable)
+	if err == nil {
+		return &Store{db: db}, nil
+	}
+	return nil, err
+}
+
+//Put records a failed change, a failed revision recorded before gets its attempts increased
+func (s *Store) Put(pipeline string, change *couchdb.Change, inerr error) error {
+	msg := "nil"
+	if inerr != nil {
+		msg = inerr.Error()
+	}
+	_, err := s.db.Exec(`INSERT INTO dead_letter(pipeline, docid, rev, seq, doc, error) VALUES(?,?,?,?,?,?)
+ON DUPLICATE KEY UPDATE seq=VALUES(seq), doc=VALUES(doc), error=VALUES(error), attempts=attempts+1`,
+		pipeline, change.ID, change.Rev(), string(change.Seq), string(change.Doc), msg)
+	return err
+}
+
+//List returns dead letters with given ids, or all of them when ids is empty
+func (s *Store) List(ids []int) ([]Letter, error) {
+	query := "SELECT id, pipeline, docid, rev, seq, doc, error, attempts FROM dead_letter"
+	args := make([]interface{}, 0, len(ids))
+	if len(ids) > 0 {
+		marks := make([]string, 0, len(ids))
+		for _, id := range ids {
+			marks = append(marks, "?")
+			args = append(args, id)
+		}
+		query = fmt.Sprintf("%s WHERE id IN (%s)", query, strings.Join(marks, ","))
+	}
+	rows, err := s.db.Query(query+" ORDER BY id", args...)
+	if err == nil {
+		defer rows.Close()
+		ret := make([]Letter, 0, 16)
+		for rows.Next() {
+			l := Letter{}
+			var doc, msg sql.NullString
+			err = rows.Scan(&l.ID, &l.Pipeline, &l.DocID, &l.Rev, &l.Seq, &doc, &msg, &l.Attempts)
+			if err != nil {
+				return nil, err
+			}
+			l.Doc = doc.String
+			l.Error = msg.String
+			ret = append(ret, l)
+		}
+		return ret, rows.Err()
+	}
+	return nil, err
+}
+
+//Resolve removes a dead letter which has been applied
+func (s *Store) Resolve(id int) error {
+	_, err := s.db.Exec("DELETE FROM dead_letter WHERE id=?", id)
+	return err
+}
+
+//Retry records another failed attempt of a dead letter
+func (s *Store) Retry(id int, inerr error) error {
+	_, err := s.db.Exec("UPDATE dead_letter SET error=?, attempts=attempts+1 WHERE id=?", inerr.Error(), id)
+	return err
+}
+
+//Poison tells whether a sink error is caused by the document itself, e.g. a duplicate key or a value which
+//does not fit its column. Other errors come from the sink and must stop the pipeline instead of becoming dead letters.
+func Poison(err error) bool {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case 1048, 1062, 1264, 1265, 1292, 1364, 1366, 1406, 1452:
+			return true
+		}
+	}
+	return false
+}
+
+//ParseIDs converts command line arguments to dead letter ids
+func ParseIDs(args []string) ([]int, error) {
+	ids := make([]int, 0, len(args))
+	for _, a := range args {
+		id, err := strconv.Atoi(a)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,170 @@
+package deadletter
+
+import (
+	"couch2mq/couchdb"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//files serializes the file stores of the process, pipelines may share a directory
+var files sync.Mutex
+
+//File keeps each dead letter in a JSON file named after its id, for deployments without MySQL
+type File struct {
+	dir string
+}
+
+//NewFile returns a store and creates dir if it does not exist
+func NewFile(dir string) (*File, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		return &File{dir: dir}, nil
+	}
+	return nil, err
+}
+
+func (f *File) path(id int) string {
+	return filepath.Join(f.dir, strconv.Itoa(id)+".json")
+}
+
+//load reads the letters of the directory ordered by id
+func (f *File) load() ([]Letter, error) {
+	names, err := filepath.Glob(filepath.Join(f.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]Letter, 0, len(names))
+	for _, name := range names {
+		if _, err = strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".json")); err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		l := Letter{}
+		if err = json.Unmarshal(b, &l); err != nil {
+			return nil, err
+		}
+		ret = append(ret, l)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret, nil
+}
+
+//write replaces the file of l atomically
+func (f *File) write(l *Letter) error {
+	b, err := json.Marshal(l)
+	if err == nil {
+		var tmp *os.File
+		tmp, err = ioutil.TempFile(f.dir, strconv.Itoa(l.ID)+".json.*")
+		if err == nil {
+			_, err = tmp.Write(b)
+			if err == nil {
+				err = tmp.Sync()
+			}
+			if cerr := tmp.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				err = os.Rename(tmp.Name(), f.path(l.ID))
+			}
+			if err != nil {
+				os.Remove(tmp.Name())
+			}
+		}
+	}
+	return err
+}
+
+//Put see Letters
+func (f *File) Put(pipeline string, change *couchdb.Change, inerr error) error {
+	msg := "nil"
+	if inerr != nil {
+		msg = inerr.Error()
+	}
+	files.Lock()
+	defer files.Unlock()
+	letters, err := f.load()
+	if err != nil {
+		return err
+	}
+	l := Letter{Pipeline: pipeline, DocID: change.ID, Rev: change.Rev()}
+	last := 0
+	for _, old := range letters {
+		if old.Pipeline == l.Pipeline && old.DocID == l.DocID && old.Rev == l.Rev {
+			l.ID = old.ID
+			l.Attempts = old.Attempts
+		}
+		last = old.ID
+	}
+	if l.ID == 0 {
+		l.ID = last + 1
+	}
+	l.Seq = string(change.Seq)
+	l.Doc = string(change.Doc)
+	l.Error = msg
+	l.Attempts++
+	return f.write(&l)
+}
+
+//List see Letters
+func (f *File) List(ids []int) ([]Letter, error) {
+	files.Lock()
+	defer files.Unlock()
+	letters, err := f.load()
+	if err != nil || len(ids) == 0 {
+		return letters, err
+	}
+	wanted := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	ret := make([]Letter, 0, len(ids))
+	for _, l := range letters {
+		if wanted[l.ID] {
+			ret = append(ret, l)
+		}
+	}
+	return ret, nil
+}
+
+//Resolve see Letters
+func (f *File) Resolve(id int) error {
+	files.Lock()
+	defer files.Unlock()
+	err := os.Remove(f.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//Retry see Letters
+func (f *File) Retry(id int, inerr error) error {
+	files.Lock()
+	defer files.Unlock()
+	b, err := ioutil.ReadFile(f.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil {
+		l := Letter{}
+		err = json.Unmarshal(b, &l)
+		if err == nil {
+			l.Error = inerr.Error()
+			l.Attempts++
+			err = f.write(&l)
+		}
+	}
+	return err
+}
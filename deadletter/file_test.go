@@ -0,0 +1,69 @@
+package deadletter
+
+import (
+	"couch2mq/couchdb"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func change(id string, rev string, seq string) *couchdb.Change {
+	return &couchdb.Change{Seq: couchdb.Sequence(seq), ID: id, Revisions: []couchdb.Rev{{Revison: rev}}, Doc: []byte(`{"_id":"` + id + `"}`)}
+}
+
+func TestFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "deadletters")
+	f, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*couchdb.Change{change("order-1", "1-a", "1"), change("order-2", "1-b", "2"), change("order-1", "1-a", "3")} {
+		if err = f.Put("orders", c, errors.New("wrong format")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = f.Put("shifts", change("order-1", "1-a", "4"), nil); err != nil {
+		t.Fatal(err)
+	}
+	letters, err := f.List(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 3 {
+		t.Fatalf("%d letters, want 3", len(letters))
+	}
+	//the same revision of a pipeline is recorded once with its attempts counted
+	l := letters[0]
+	if l.ID != 1 || l.Pipeline != "orders" || l.DocID != "order-1" || l.Seq != "3" || l.Attempts != 2 || l.Error != "wrong format" {
+		t.Errorf("first letter is %+v", l)
+	}
+	if c := l.Change(); c.ID != "order-1" || c.Rev() != "1-a" || string(c.Doc) != `{"_id":"order-1"}` {
+		t.Errorf("change of the first letter is %+v", c)
+	}
+	if letters[2].ID != 3 || letters[2].Pipeline != "shifts" || letters[2].Error != "nil" {
+		t.Errorf("third letter is %+v", letters[2])
+	}
+	if err = f.Retry(2, errors.New("duplicate key")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Resolve(1); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Resolve(1); err != nil {
+		t.Errorf("Resolve of a resolved letter returned %v", err)
+	}
+	letters, err = f.List([]int{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].ID != 2 || letters[0].Attempts != 2 || letters[0].Error != "duplicate key" {
+		t.Errorf("letters are %+v", letters)
+	}
+	//a new letter never reuses the id of a remaining one
+	if err = f.Put("orders", change("order-9", "1-z", "9"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if letters, _ = f.List([]int{4}); len(letters) != 1 {
+		t.Errorf("letter 4 is %+v", letters)
+	}
+}
@@ -0,0 +1,117 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//Check returns nil when a dependency is usable
+type Check func() error
+
+//Monitor tracks the last successful loop of every pipeline and answers health checks
+type Monitor struct {
+	mu             sync.Mutex
+	last           map[string]time.Time
+	checks         map[string]Check
+	staleness      time.Duration
+	readyStaleness time.Duration
+}
+
+//Status is the body of /healthz and /readyz
+type Status struct {
+	OK        bool              `json:"ok"`
+	Pipelines map[string]string `json:"pipelines"`
+}
+
+//New returns a monitor, a pipeline is unhealthy when it has not looped within staleness
+//and not ready when it has not looped within readyStaleness
+func New(staleness time.Duration, readyStaleness time.Duration) *Monitor {
+	return &Monitor{
+		last:           make(map[string]time.Time),
+		checks:         make(map[string]Check),
+		staleness:      staleness,
+		readyStaleness: readyStaleness,
+	}
+}
+
+//Beat records a successful loop of pipeline
+func (m *Monitor) Beat(pipeline string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last[pipeline] = time.Now()
+}
+
+//Ready registers the readiness check of pipeline, replacing the previous one
+func (m *Monitor) Ready(pipeline string, check Check) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checks[pipeline] = check
+	if _, ok := m.last[pipeline]; !ok {
+		m.last[pipeline] = time.Now()
+	}
+}
+
+func (m *Monitor) stale(within time.Duration) Status {
+	st := Status{
+		OK:        true,
+		Pipelines: make(map[string]string),
+	}
+	for name, last := range m.last {
+		age := time.Since(last)
+		if within > 0 && age > within {
+			st.OK = false
+			st.Pipelines[name] = "no successful loop for " + age.String()
+		} else {
+			st.Pipelines[name] = "last successful loop " + age.String() + " ago"
+		}
+	}
+	return st
+}
+
+//Health reports whether every pipeline has looped within staleness
+func (m *Monitor) Health() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stale(m.staleness)
+}
+
+//Readiness runs the checks of every pipeline
+func (m *Monitor) Readiness() Status {
+	m.mu.Lock()
+	checks := make(map[string]Check, len(m.checks))
+	for name, check := range m.checks {
+		checks[name] = check
+	}
+	st := m.stale(m.readyStaleness)
+	m.mu.Unlock()
+	if len(checks) == 0 {
+		st.OK = false
+	}
+	for name, check := range checks {
+		if err := check(); err != nil {
+			st.OK = false
+			st.Pipelines[name] = err.Error()
+		}
+	}
+	return st
+}
+
+func write(w http.ResponseWriter, st Status) {
+	w.Header().Set("Content-Type", "application/json")
+	if !st.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
+
+//Handle registers /healthz and /readyz on mux
+func (m *Monitor) Handle(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		write(w, m.Health())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		write(w, m.Readiness())
+	})
+}
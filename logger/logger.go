@@ -5,8 +5,8 @@ import (
 	"couch2mq/tunnel"
 	"database/sql"
 	"fmt"
-	"strconv"
 	"strings"
+	"time"
 )
 
 //Logger holds the handle of database
@@ -16,55 +16,74 @@ type Logger struct {
 	table string
 }
 
-func seq2index(seq string) (int, error) {
-	s := strings.SplitN(seq, "-", 2)
-	return strconv.Atoi(s[0])
+//bastion converts ssh settings of configuration, jump hosts included
+func bastion(cfg config.SSH) tunnel.SSH {
+	s := tunnel.SSH{
+		Host:        cfg.Host,
+		Port:        cfg.Port,
+		User:        cfg.Username,
+		Password:    cfg.Password,
+		KeyFile:     cfg.KeyFile,
+		Passphrase:  cfg.Passphrase,
+		Agent:       cfg.Agent,
+		KnownHosts:  cfg.KnownHosts,
+		Fingerprint: cfg.Fingerprint,
+		Insecure:    cfg.Insecure,
+		Keepalive:   time.Duration(cfg.Keepalive) * time.Millisecond,
+	}
+	for _, jump := range cfg.Jumps {
+		s.Jumps = append(s.Jumps, bastion(jump))
+	}
+	return s
 }
 
-//New creates log database and create sequence table
-func New(tbl string) (*Logger, error) {
-	sql := make(map[string]interface{})
-	err := config.Get("$.mysql+", &sql)
+//tlsConfig converts tls settings of configuration, nil stays nil
+func tlsConfig(cfg *config.TLS) *tunnel.TLS {
+	if cfg == nil {
+		return nil
+	}
+	return &tunnel.TLS{
+		CA:         cfg.CA,
+		Cert:       cfg.Cert,
+		Key:        cfg.Key,
+		ServerName: cfg.ServerName,
+		Verify:     cfg.Verify,
+	}
+}
+
+//New creates log database and create sequence table, the tunnel is named after the table
+func New(cfg config.MySQL, tbl string) (*Logger, error) {
+	var t *tunnel.Tunnel
+	var err error
+	if cfg.SSH != nil {
+		t, err = tunnel.OpenSSH(
+			tbl,
+			bastion(*cfg.SSH),
+			cfg.Host,
+			cfg.Port,
+			cfg.Username,
+			cfg.Password,
+			cfg.Database,
+			tlsConfig(cfg.TLS))
+	} else {
+		t, err = tunnel.Open(
+			tbl,
+			cfg.Host,
+			cfg.Port,
+			cfg.Username,
+			cfg.Password,
+			cfg.Database,
+			tlsConfig(cfg.TLS))
+	}
 	if err == nil {
-		if s, ok := sql["ssh"]; ok {
-			ssh := s.(map[string]interface{})
-			t, err := tunnel.OpenSSH(
-				ssh["host"].(string),
-				int(ssh["port"].(float64)),
-				ssh["username"].(string),
-				ssh["password"].(string),
-				sql["host"].(string),
-				int(sql["port"].(float64)),
-				sql["username"].(string),
-				sql["password"].(string),
-				sql["database"].(string))
-			if err == nil {
-				log := Logger{
-					ssh:   t,
-					db:    t.Database,
-					table: tbl,
-				}
-				return &log, nil
-			}
-			return nil, err
+		log := Logger{
+			ssh:   t,
+			db:    t.Database,
+			table: tbl,
 		}
-		t, err := tunnel.Open(
-			sql["host"].(string),
-			int(sql["port"].(float64)),
-			sql["username"].(string),
-			sql["password"].(string),
-			sql["database"].(string))
-		if err == nil {
-			log := Logger{
-				ssh:   t,
-				db:    t.Database,
-				table: tbl,
-			}
-			return &log, nil
-		}
-		return nil, err
+		return &log, nil
 	}
-	panic("There is no available mysql configuration")
+	return nil, err
 }
 
 //DB return the database handle
@@ -83,6 +102,28 @@ func (log *Logger) Truncate() error {
 	return err
 }
 
+//Migrate turns the id of a sequence table created by older versions, which was the numeric prefix of seq,
+//into an AUTO_INCREMENT column. Only the most recently written row is kept, the old ids are not ordered by time.
+func (log *Logger) Migrate() error {
+	var extra string
+	err := log.db.QueryRow(`SELECT EXTRA FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = 'id'`, log.table).Scan(&extra)
+	if err != nil || strings.Contains(strings.ToLower(extra), "auto_increment") {
+		return err
+	}
+	var id int64
+	err = log.db.QueryRow(fmt.Sprintf("SELECT id FROM %s ORDER BY timestamp DESC, id DESC LIMIT 1", log.table)).Scan(&id)
+	if err == nil {
+		_, err = log.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE id <> ?`, log.table), id)
+	} else if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err == nil {
+		_, err = log.db.Exec(fmt.Sprintf(`ALTER TABLE %s MODIFY id bigint(20) NOT NULL AUTO_INCREMENT`, log.table))
+	}
+	return err
+}
+
 //Clean clears sequence table except the latest one
 func (log *Logger) Clean() error {
 	mid, err := log.MaxID()
@@ -95,78 +136,49 @@ func (log *Logger) Clean() error {
 
 //Count returns the count of records in sequence
 func (log *Logger) Count() (int, error) {
-	rows, err := log.db.Query(fmt.Sprintf("SELECT COUNT(*) FROM %s", log.table))
-	if err == nil {
-		defer rows.Close()
-		if rows.Next() {
-			cn := 0
-			err = rows.Scan(&cn)
-			if err == nil {
-				return cn, nil
-			}
-		}
-	}
-	return 0, err
+	cn := 0
+	err := log.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", log.table)).Scan(&cn)
+	return cn, err
 }
 
-//MaxID return the max id in sequence
-func (log *Logger) MaxID() (int, error) {
-	cn, err := log.Count()
-	if err == nil {
-		if cn == 0 {
-			return 1, nil
-		}
-	}
-	rows, err := log.db.Query(fmt.Sprintf("SELECT MAX(id) FROM %s", log.table))
-	if err == nil {
-		defer rows.Close()
-		if rows.Next() {
-			id := 1
-			err = rows.Scan(&id)
-			if err == nil {
-				return id, nil
-			}
-		}
-	}
-	return 1, err
+//MaxID return the id of the latest record in sequence, 0 when there is none
+func (log *Logger) MaxID() (int64, error) {
+	var id int64
+	err := log.db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(id), 0) FROM %s", log.table)).Scan(&id)
+	return id, err
 }
 
-//Seq retrieves the latest sequence number
+//Seq retrieves the latest sequence number, seqs are opaque and ordered by insertion
 func (log *Logger) Seq() (string, error) {
-	cn, err := log.Count()
-	if err == nil {
-		if cn == 0 {
-			return "", nil
-		}
-	}
-	mid, err := log.MaxID()
-	if err == nil {
-		rows, err := log.db.Query(fmt.Sprintf("SELECT seq FROM %s where id=?", log.table), mid)
-		if err == nil {
-			defer rows.Close()
-			if rows.Next() {
-				seq := ""
-				err = rows.Scan(&seq)
-				if err == nil {
-					return seq, nil
-				}
-			}
-		}
+	seq := ""
+	err := log.db.QueryRow(fmt.Sprintf("SELECT seq FROM %s ORDER BY id DESC LIMIT 1", log.table)).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
-	return "", nil
+	return seq, err
 }
 
-//Update updates the lastest sequence number
+//Update appends the lastest sequence number
 func (log *Logger) Update(seq string, docid string, inerr error) error {
-	stmt, err := log.db.Prepare(fmt.Sprintf(`INSERT INTO %s(id, seq, docid, error) VALUES(?,?,?,?)`, log.table))
+	stmt, err := log.db.Prepare(fmt.Sprintf(`INSERT INTO %s(seq, docid, error) VALUES(?,?,?)`, log.table))
 	if err == nil {
-		id, _ := seq2index(seq)
+		defer stmt.Close()
 		if inerr == nil {
-			_, err = stmt.Exec(id, seq, docid, "nil")
+			_, err = stmt.Exec(seq, docid, "nil")
 			return err
 		}
-		_, err = stmt.Exec(id, seq, docid, inerr.Error())
+		_, err = stmt.Exec(seq, docid, inerr.Error())
 		return err
 	}
 	return err
 }
+
+//UpdateTx appends the lastest sequence number in tx, so that it is committed along with the data
+func (log *Logger) UpdateTx(tx *sql.Tx, seq string, docid string, inerr error) error {
+	msg := "nil"
+	if inerr != nil {
+		msg = inerr.Error()
+	}
+	_, err := tx.Exec(fmt.Sprintf(`INSERT INTO %s(seq, docid, error) VALUES(?,?,?)`, log.table), seq, docid, msg)
+	return err
+}
@@ -1,22 +1,37 @@
 package main
 
 import (
+	"context"
+	"couch2mq/applog"
+	"couch2mq/checkpoint"
 	"couch2mq/config"
 	"couch2mq/couchdb"
+	"couch2mq/deadletter"
+	"couch2mq/health"
 	"couch2mq/logger"
+	"couch2mq/metrics"
 	"couch2mq/oc"
+	"couch2mq/retry"
+	"couch2mq/sink"
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"log"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gchaincl/dotsql"
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/kr/pretty"
 )
 
 //VERSION defines the version number of this program
@@ -24,14 +39,47 @@ const VERSION string = "1.0.1"
 
 func failOnError(err error, msg string) {
 	if err != nil {
-		log.Panicf("%s: %s", msg, err)
+		panic(fmt.Sprintf("%s: %s", msg, err))
 	}
 }
-func getChanges(client *couchdb.Client, dbname string, since string) (*couchdb.Changes, error) {
+
+//getChanges opens change feeds of dbname in the mode of couchdb.feed, filter is nil when every change is followed
+func getChanges(ctx context.Context, client *couchdb.Client, dbname string, filter *couchdb.Filter, since string, couchcfg config.CouchDB) (couchdb.IChanges, error) {
 	//db, err := client.EnsureDB(dbname)
 	db, err := client.DB(dbname)
 	failOnError(err, "Failed to connect to "+dbname)
-	return db.NormalChanges(since)
+	db = db.WithContext(ctx).WithFilter(filter)
+	switch couchcfg.Feed {
+	case "normal":
+		d, _ := time.ParseDuration("5s")
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		ch, err := db.NormalChanges(since)
+		if err == nil {
+			return ch, nil
+		}
+		return nil, err
+	case "longpoll":
+		ch, err := db.LongpollChanges(since, couchcfg.Timeout)
+		if err == nil {
+			return ch, nil
+		}
+		return nil, err
+	}
+	heartbeat := couchcfg.Heartbeat
+	if filter != nil && couchcfg.Timeout > 0 {
+		//CouchDB ignores timeout while heartbeats are sent, without them a filtered feed ends after timeout
+		//and reports the last_seq it scanned up to, which becomes the checkpoint
+		heartbeat = 0
+	}
+	ch, err := db.ContinuousChanges(since, heartbeat, couchcfg.Timeout)
+	if err == nil {
+		return ch, nil
+	}
+	return nil, err
 }
 
 func panicOnError(err error) {
@@ -40,34 +88,39 @@ func panicOnError(err error) {
 		panic(err)
 	}
 }
-func forever(fn func()) {
+
+//forever restarts fn when it panics, waiting longer after every consecutive failure, until ctx is done
+func forever(ctx context.Context, fn func(ctx context.Context)) {
 	f := func() {
 		defer func() {
 			if r := recover(); r != nil {
-				debug.PrintStack()
-				pretty.Println("Recover from error:", r)
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Error("recover from error", "error", r, "stack", string(debug.Stack()))
 			}
 		}()
-		fn()
+		fn(ctx)
 	}
-	for {
+	failures := 0
+	for ctx.Err() == nil {
+		start := time.Now()
 		f()
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > policy.MaxBackoff {
+			failures = 0
+		}
+		failures++
+		d := policy.Backoff(failures)
+		slog.Info("restart", "backoff", d)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+		}
 	}
 }
-func doOrder(db *sql.DB, order oc.OrderJSON) error {
-	statements := order.Do(db)
-	tx, err := db.Begin()
-	failOnError(err, "Failed to begine transaction")
-	defer tx.Rollback()
-	for _, stmt := range statements {
-		_, err := tx.Exec(stmt)
-		failOnError(err, "Failed to exec "+stmt)
-	}
-	pretty.Println("Commit transaction", order.Order.OrderInfo.OrderID)
-	return tx.Commit()
-}
-
-const seqPrefixLen = 20
 
 //INI_SQL defines the sql statements for creating tables
 const INI_SQL = `
@@ -238,103 +291,802 @@ CREATE TABLE order_meal_detail (
 DROP TABLE IF EXISTS order_seq;
 -- name: create-order-seq
 CREATE TABLE order_seq (
-  id int(11) NOT NULL,
+  id bigint(20) NOT NULL AUTO_INCREMENT,
   seq varchar(2048) NOT NULL,
   docid varchar(2048) DEFAULT NULL,
   error varchar(2048) DEFAULT NULL,
   timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY (id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+-- name: drop-applied-revision
+DROP TABLE IF EXISTS applied_revision;
 -- name: drop-shift-seq
 DROP TABLE IF EXISTS shift_seq;
 -- name: create-shift-seq
-CREATE TABLE shift_seq (
-  id int(11) NOT NULL,
+CREATE TABLE IF NOT EXISTS shift_seq (
+  id bigint(20) NOT NULL AUTO_INCREMENT,
   seq varchar(2048) NOT NULL,
   docid varchar(2048) DEFAULT NULL,
   error varchar(2048) DEFAULT NULL,
   timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY (id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+-- name: drop-shift-master
+DROP TABLE IF EXISTS shift_master;
+-- name: create-shift-master
+CREATE TABLE IF NOT EXISTS shift_master (
+  shiftId varchar(100) NOT NULL COMMENT '交班ID',
+  storeId varchar(50) DEFAULT NULL COMMENT '门店ID',
+  storeName varchar(255) DEFAULT NULL COMMENT '门店名称',
+  operaterName varchar(50) DEFAULT NULL COMMENT '操作员',
+  machineId varchar(50) DEFAULT NULL COMMENT '机器编号',
+  printerName varchar(50) DEFAULT NULL COMMENT '打印人',
+  isPost int(2) DEFAULT '0' COMMENT '是否上传',
+  printerTime datetime DEFAULT NULL COMMENT '打印时间',
+  startTime datetime DEFAULT NULL COMMENT '开始时间',
+  endTime datetime DEFAULT NULL COMMENT '结束时间',
+  orderNum int(11) DEFAULT '0' COMMENT '订单数',
+  total int(11) DEFAULT '0' COMMENT '营业总额（分为单位）',
+  mainIncome int(11) DEFAULT '0' COMMENT '主营收入',
+  otherIncome int(11) DEFAULT '0' COMMENT '其他收入',
+  netIncome int(11) DEFAULT '0' COMMENT '净收入',
+  discount int(11) DEFAULT '0' COMMENT '优惠',
+  discart int(11) DEFAULT '0' COMMENT '抹零',
+  shouldMoy int(11) DEFAULT '0' COMMENT '应收',
+  totalCash int(11) DEFAULT '0' COMMENT '现金',
+  crossDateTime varchar(50) DEFAULT NULL COMMENT '跨日时间',
+  refundTimes int(11) DEFAULT '0' COMMENT '退款次数',
+  refund int(11) DEFAULT '0' COMMENT '退款金额',
+  allGift int(11) DEFAULT '0' COMMENT '赠送',
+  disOutMoney int(11) DEFAULT '0',
+  inOrderNum int(11) DEFAULT '0' COMMENT '堂食单数',
+  inOrderMoney int(11) DEFAULT '0' COMMENT '堂食金额',
+  outOrderNum int(11) DEFAULT '0' COMMENT '外卖单数',
+  outOrderMoney int(11) DEFAULT '0' COMMENT '外卖金额',
+  erpSid varchar(100) DEFAULT NULL COMMENT 'ERP交班ID',
+  posId varchar(50) DEFAULT NULL COMMENT 'POS编号',
+  posType varchar(50) DEFAULT NULL COMMENT 'POS类型',
+  posStart int(11) DEFAULT '0',
+  posEnd int(11) DEFAULT '0',
+  posUser varchar(50) DEFAULT NULL,
+  operatingIncome int(11) DEFAULT '0' COMMENT '营业收入',
+  totalOrders int(11) DEFAULT '0' COMMENT '订单总数',
+  erpDiscount int(11) DEFAULT '0',
+  erpTotalCash int(11) DEFAULT '0',
+  gift int(11) DEFAULT '0',
+  couponOvercharge int(11) DEFAULT '0',
+  erpRefund int(11) DEFAULT '0',
+  erpRefundTimes int(11) DEFAULT '0',
+  posRecordsNo int(11) DEFAULT '0',
+  createTime datetime DEFAULT NULL COMMENT '创建时间',
+  PRIMARY KEY (shiftId),
+  KEY storeId (storeId),
+  KEY startTime (startTime)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='交班表';
+-- name: drop-shift-other-income
+DROP TABLE IF EXISTS shift_other_income;
+-- name: create-shift-other-income
+CREATE TABLE IF NOT EXISTS shift_other_income (
+  id int(11) NOT NULL AUTO_INCREMENT,
+  shiftId varchar(100) NOT NULL COMMENT '交班ID',
+  kindName varchar(100) DEFAULT NULL COMMENT '收入类型',
+  number varchar(50) DEFAULT NULL COMMENT '数量',
+  totalAmount int(11) DEFAULT '0' COMMENT '金额',
+  PRIMARY KEY (id),
+  KEY shiftId (shiftId)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='交班其他收入表';
+-- name: drop-shift-payment
+DROP TABLE IF EXISTS shift_payment;
+-- name: create-shift-payment
+CREATE TABLE IF NOT EXISTS shift_payment (
+  id int(11) NOT NULL AUTO_INCREMENT,
+  shiftId varchar(100) NOT NULL COMMENT '交班ID',
+  payType varchar(50) DEFAULT NULL COMMENT '支付方式',
+  amount int(11) DEFAULT '0' COMMENT '系统金额',
+  PRIMARY KEY (id),
+  KEY shiftId (shiftId)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='交班支付汇总表';
+-- name: drop-shift-order
+DROP TABLE IF EXISTS shift_order;
+-- name: create-shift-order
+CREATE TABLE IF NOT EXISTS shift_order (
+  id int(11) NOT NULL AUTO_INCREMENT,
+  shiftId varchar(100) NOT NULL COMMENT '交班ID',
+  orderId varchar(50) NOT NULL COMMENT '订单ID',
+  PRIMARY KEY (id),
+  KEY shiftId (shiftId),
+  KEY orderId (orderId)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='交班订单表';
 -- name: enable-foreign-key
 SET FOREIGN_KEY_CHECKS = 1;`
 
 var initDB bool
 
-func handleOrders() {
-	lg, err := logger.New("order_seq")
+//shutdownTimeout bounds how long pipelines may take to stop after SIGINT or SIGTERM
+const shutdownTimeout = 60 * time.Second
+
+var cfg = config.Default()
+
+var policy = retry.New(cfg.Retry)
+
+var monitor = health.New(0, 0)
+
+var errWrongFormat = errors.New("Wrong JSON format")
+
+//errSkip is returned by decoders for documents which have nothing to apply, e.g. design documents,
+//such changes are checkpointed without touching the sink and never become dead letters
+var errSkip = errors.New("Skipped")
+
+//designDoc tells whether id is a design document, which only holds views and filters
+func designDoc(id string) bool {
+	return strings.HasPrefix(id, "_design/")
+}
+
+//decoder parses the document of a change
+type decoder func(data []byte) (oc.Document, error)
+
+//decodeOrder parses an order, a tombstone which no longer carries the order cannot tell which rows to delete and is skipped
+func decodeOrder(data []byte) (oc.Document, error) {
+	var dst oc.OrderJSON
+	err := json.Unmarshal(data, &dst)
+	if err == nil && designDoc(dst.ID) {
+		return nil, errSkip
+	}
+	if err == nil && dst.Order.OrderInfo.OrderID == "" {
+		if dst.Deleted {
+			return nil, errSkip
+		}
+		err = errWrongFormat
+	}
+	return &dst, err
+}
+
+//decodeShift parses a shift report, the shift is identified by the document id so that tombstones delete it
+func decodeShift(data []byte) (oc.Document, error) {
+	var dst oc.ShiftJSON
+	err := json.Unmarshal(data, &dst)
+	if err == nil && designDoc(dst.ID) {
+		return nil, errSkip
+	}
+	if err == nil && (dst.ID == "" || (!dst.Deleted && dst.Data.StoreID == "")) {
+		err = errWrongFormat
+	}
+	return &dst, err
+}
+
+func initDatabase() {
+	lg, err := logger.New(cfg.MySQL, "order_seq")
 	failOnError(err, "Failed to open database")
 	defer lg.Close()
-	if initDB {
-		pretty.Println("Initialize database")
-		dot, err := dotsql.LoadFromString(INI_SQL)
-		failOnError(err, "Failed to initialize database")
-		dot.Exec(lg.DB(), "use-oc")
-		dot.Exec(lg.DB(), "set-encoding")
-		dot.Exec(lg.DB(), "disable-foreign-key")
-		dot.Exec(lg.DB(), "drop-order-discount")
-		dot.Exec(lg.DB(), "create-order-discount")
-		dot.Exec(lg.DB(), "drop-order-detail")
-		dot.Exec(lg.DB(), "create-order-detail")
-		dot.Exec(lg.DB(), "drop-order-master")
-		dot.Exec(lg.DB(), "create-order-master")
-		dot.Exec(lg.DB(), "drop-order-meal-detail")
-		dot.Exec(lg.DB(), "create-order-meal-detail")
-		dot.Exec(lg.DB(), "drop-order-seq")
-		dot.Exec(lg.DB(), "create-order-seq")
-		dot.Exec(lg.DB(), "drop-shift-seq")
-		dot.Exec(lg.DB(), "create-shift-seq")
-		dot.Exec(lg.DB(), "enable-foreign-key")
-		initDB = false
-	}
-	seq, err := lg.Seq()
-	failOnError(err, "Failed to get latest sequence number")
-	err = lg.Clean()
-	failOnError(err, "Failed to clean up log")
-	for {
-		d, _ := time.ParseDuration("5s")
-		time.Sleep(d)
-		couchcfg := make(map[string]interface{})
-		err := config.Get("$.couchdb+", &couchcfg)
-		failOnError(err, "Empty CouchDB configuration")
-		client, err := couchdb.New(couchcfg["url"].(string), couchcfg["username"].(string), couchcfg["password"].(string))
+	slog.Info("initialize database")
+	dot, err := dotsql.LoadFromString(INI_SQL)
+	failOnError(err, "Failed to initialize database")
+	dot.Exec(lg.DB(), "use-oc")
+	dot.Exec(lg.DB(), "set-encoding")
+	dot.Exec(lg.DB(), "disable-foreign-key")
+	dot.Exec(lg.DB(), "drop-order-discount")
+	dot.Exec(lg.DB(), "create-order-discount")
+	dot.Exec(lg.DB(), "drop-order-detail")
+	dot.Exec(lg.DB(), "create-order-detail")
+	dot.Exec(lg.DB(), "drop-order-master")
+	dot.Exec(lg.DB(), "create-order-master")
+	dot.Exec(lg.DB(), "drop-order-meal-detail")
+	dot.Exec(lg.DB(), "create-order-meal-detail")
+	dot.Exec(lg.DB(), "drop-order-seq")
+	dot.Exec(lg.DB(), "create-order-seq")
+	dot.Exec(lg.DB(), "drop-applied-revision")
+	dot.Exec(lg.DB(), "drop-shift-seq")
+	dot.Exec(lg.DB(), "create-shift-seq")
+	dot.Exec(lg.DB(), "drop-shift-master")
+	dot.Exec(lg.DB(), "create-shift-master")
+	dot.Exec(lg.DB(), "drop-shift-other-income")
+	dot.Exec(lg.DB(), "create-shift-other-income")
+	dot.Exec(lg.DB(), "drop-shift-payment")
+	dot.Exec(lg.DB(), "create-shift-payment")
+	dot.Exec(lg.DB(), "drop-shift-order")
+	dot.Exec(lg.DB(), "create-shift-order")
+	dot.Exec(lg.DB(), "enable-foreign-key")
+}
+
+//decoders maps pipeline names to their document decoders
+var decoders = map[string]decoder{
+	"orders": decodeOrder,
+	"shifts": decodeShift,
+}
+
+//schemas lists INI_SQL queries which create missing tables of a pipeline when it starts,
+//so that enabling a pipeline does not need --init, which drops the order tables
+var schemas = map[string][]string{
+	"shifts": {
+		"create-shift-seq",
+		"create-shift-master",
+		"create-shift-other-income",
+		"create-shift-payment",
+		"create-shift-order",
+	},
+}
+
+//createTables creates missing tables of pipeline name
+func createTables(db *sql.DB, name string) error {
+	dot, err := dotsql.LoadFromString(INI_SQL)
+	if err == nil {
+		for _, q := range schemas[name] {
+			_, err = dot.Exec(db, q)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return err
+}
+
+//couchAuth returns the authenticator selected by couchdb.auth, nil for anonymous access
+func couchAuth(c config.CouchDB) couchdb.Authenticator {
+	switch c.Auth {
+	case "cookie":
+		return &couchdb.CookieAuth{Username: c.Username, Password: c.Password}
+	case "jwt":
+		return &couchdb.JWTAuth{Token: c.Token, File: c.TokenFile}
+	case "proxy":
+		return &couchdb.ProxyAuth{Username: c.Username, Roles: c.Roles, Secret: c.Secret}
+	}
+	if len(c.Username) > 0 {
+		return &couchdb.BasicAuth{Username: c.Username, Password: c.Password}
+	}
+	return nil
+}
+
+//couchOptions converts transport settings of configuration
+func couchOptions(c config.CouchDB) couchdb.Options {
+	return couchdb.Options{
+		CA:              c.CA,
+		Cert:            c.Cert,
+		Key:             c.Key,
+		ServerName:      c.ServerName,
+		Insecure:        c.Insecure,
+		Proxy:           c.Proxy,
+		ConnectTimeout:  time.Duration(c.ConnectTimeout) * time.Millisecond,
+		TLSTimeout:      time.Duration(c.TLSTimeout) * time.Millisecond,
+		ResponseTimeout: time.Duration(c.ResponseTimeout) * time.Millisecond,
+	}
+}
+
+//changesFilter converts the filter of a pipeline, nil stays nil
+func changesFilter(f *config.Filter) *couchdb.Filter {
+	if f == nil {
+		return nil
+	}
+	return &couchdb.Filter{
+		Type:     f.Type,
+		Selector: f.Selector,
+		DocIDs:   f.DocIDs,
+		View:     f.View,
+		Params:   f.Params,
+	}
+}
+
+//checkpointer returns the checkpoint selected by p, the sequence table of lg is migrated and cleaned up when it is used
+func checkpointer(name string, p config.Pipeline, lg *logger.Logger, client *couchdb.Client) (checkpoint.Checkpointer, error) {
+	switch p.Checkpoint.Type {
+	case "couchdb":
+		db, err := client.DB(p.Database)
+		if err == nil {
+			return checkpoint.NewLocal(db, name), nil
+		}
+		return nil, err
+	case "file":
+		return checkpoint.NewFile(p.Checkpoint.Path), nil
+	}
+	err := lg.Migrate()
+	if err == nil {
+		err = lg.Clean()
+		if err == nil {
+			return lg, nil
+		}
+	}
+	return nil, err
+}
+
+//deadLetters opens the dead letters selected by configuration, db is nil when MySQL is not used
+func deadLetters(db *sql.DB) (deadletter.Letters, error) {
+	if cfg.DeadLetter.Type == "file" {
+		return deadletter.NewFile(cfg.DeadLetter.Path)
+	}
+	return deadletter.New(db)
+}
+
+//follow returns a pipeline which puts changes of the CouchDB database of p into sink and checkpoints in table
+func follow(name string, p config.Pipeline, table string) func(ctx context.Context) {
+	filter := changesFilter(p.Filter)
+	return func(ctx context.Context) {
+		//lg stays nil when the pipeline does not use MySQL
+		var lg *logger.Logger
+		var db *sql.DB
+		if cfg.UsesMySQL(p) {
+			err := policy.Do(ctx, func() (err error) {
+				lg, err = logger.New(cfg.MySQL, table)
+				return err
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			failOnError(err, "Failed to open database")
+			defer lg.Close()
+			db = lg.DB()
+		}
+		if cfg.Sink.Type == "mysql" {
+			err := createTables(db, name)
+			failOnError(err, "Failed to create tables of "+name)
+		}
+		dl, err := deadLetters(db)
+		failOnError(err, "Failed to open dead letters")
+		sk, err := sink.New(p.Route(cfg.Sink), db)
+		failOnError(err, "Failed to create sink")
+		err = sk.Open()
+		failOnError(err, "Failed to open sink")
+		defer sk.Close()
+		client, err := couchdb.New(cfg.CouchDB.URL, couchAuth(cfg.CouchDB), couchOptions(cfg.CouchDB))
 		failOnError(err, "Failed to connect to CouchDB")
-		ch, err := getChanges(client, "orders", seq)
-		failOnError(err, "Failed to get changes of orders")
-		for _, c := range ch.Results {
-			var dst oc.OrderJSON
-			err = json.Unmarshal(c.Doc, &dst)
-			if (err != nil) || (dst.Order.OrderInfo.OrderID == "") {
-				seq = string(c.Seq)
-				pretty.Println("Cannot unmarshal doc", c.ID, seq[:seqPrefixLen])
-				if err == nil {
-					err = lg.Update(seq, c.ID, errors.New("Wrong JSON format"))
-					pretty.Println("Wrong JSON format", seq[:seqPrefixLen])
-				} else {
-					pretty.Println(err.Error(), seq[:seqPrefixLen])
-					err = lg.Update(seq, c.ID, err)
-				}
-				if err != nil {
-					pretty.Println(err.Error(), seq[:seqPrefixLen])
-				}
-				continue
+		cp, err := checkpointer(name, p, lg, client)
+		failOnError(err, "Failed to open checkpoint")
+		seq, err := cp.Seq()
+		failOnError(err, "Failed to get latest sequence number")
+		metrics.SetCheckpoint(name, seq)
+		monitor.Ready(name, func() error {
+			err := client.Ping()
+			if err == nil && db != nil {
+				err = db.Ping()
 			}
-			err = doOrder(lg.DB(), dst)
 			if err == nil {
-				seq = string(c.Seq)
-				pretty.Println("Handle doc successfully", c.ID, seq[:seqPrefixLen])
-				err = lg.Update(seq, c.ID, errors.New("Success"))
-				if err != nil {
-					pretty.Println(err, seq[:seqPrefixLen])
+				_, err = cp.Seq()
+			}
+			return err
+		})
+		for ctx.Err() == nil {
+			var ch couchdb.IChanges
+			err := policy.Do(ctx, func() (err error) {
+				ch, err = getChanges(ctx, client, p.Database, filter, seq, cfg.CouchDB)
+				return err
+			})
+			if ctx.Err() != nil {
+				break
+			}
+			if err != nil {
+				metrics.Failures.WithLabelValues(name, metrics.ReasonFeed).Inc()
+			}
+			failOnError(err, "Failed to get changes of "+p.Database)
+			monitor.Beat(name)
+			if con, ok := ch.(*couchdb.ConChanges); ok {
+				con.OnRead = func() {
+					monitor.Beat(name)
 				}
 			}
+			//with the mysql sink the checkpoint is written in the transaction of the changes
+			m, ok := sk.(*sink.MySQL)
+			store, mysqlDL := dl.(*deadletter.Store)
+			if ok && mysqlDL && p.Checkpoint.Type == "mysql" {
+				seq, err = drainBatch(ctx, name, ch, seq, p, lg, store, m)
+			} else {
+				seq, err = drain(ctx, name, ch, seq, cp, dl, sk)
+			}
+			setPending(name, ch)
+			if err != nil && ctx.Err() == nil {
+				metrics.Failures.WithLabelValues(name, metrics.ReasonFeed).Inc()
+				slog.Warn("change feeds interrupted, reconnect", "pipeline", name, "seq", applog.Seq(seq), "error", err)
+				time.Sleep(policy.Backoff(1))
+			}
+		}
+		slog.Info("stop pipeline", "pipeline", name, "seq", applog.Seq(seq))
+	}
+}
+
+//setPending records the pending count reported by change feeds
+func setPending(name string, ch couchdb.IChanges) {
+	switch c := ch.(type) {
+	case *couchdb.Changes:
+		metrics.Pending.WithLabelValues(name).Set(float64(c.Pending))
+	case *couchdb.ConChanges:
+		if len(c.LastSeq) > 0 {
+			metrics.Pending.WithLabelValues(name).Set(float64(c.Pending))
+		}
+	}
+}
+
+//lastSeq returns the last_seq reported at the end of change feeds, empty when the feed did not end cleanly
+func lastSeq(ch couchdb.IChanges) string {
+	switch c := ch.(type) {
+	case *couchdb.Changes:
+		return string(c.LastReq)
+	case *couchdb.ConChanges:
+		return string(c.LastSeq)
+	}
+	return ""
+}
+
+//advance stores the last_seq of a feed which ended cleanly, so that changes filtered out are not fetched again.
+//It returns the new checkpoint, or seq when there is nothing to store or the update failed.
+func advance(name string, ch couchdb.IChanges, seq string, cp checkpoint.Checkpointer) string {
+	last := lastSeq(ch)
+	if len(last) == 0 || last == seq {
+		return seq
+	}
+	err := cp.Update(last, "", nil)
+	if err != nil {
+		metrics.Failures.WithLabelValues(name, metrics.ReasonCheckpoint).Inc()
+		slog.Error("cannot update checkpoint", "pipeline", name, "seq", applog.Seq(last), "error", err)
+		return seq
+	}
+	slog.Debug("checkpoint advanced to last_seq", "pipeline", name, "seq", applog.Seq(last))
+	metrics.SetCheckpoint(name, last)
+	return last
+}
+
+//decodeError marks errors of decoding documents
+type decodeError struct {
+	error
+}
+
+func (e decodeError) Unwrap() error {
+	return e.error
+}
+
+//poison tells whether err is caused by the document, only those changes become dead letters
+func poison(err error) bool {
+	var de decodeError
+	return errors.As(err, &de) || deadletter.Poison(err)
+}
+
+//apply decodes a change and writes it into sink, it returns the key of the document
+func apply(name string, c *couchdb.Change, sk sink.Sink) (string, error) {
+	dst, err := decoders[name](c.Doc)
+	if err == errSkip {
+		return "", err
+	}
+	if err != nil {
+		return "", decodeError{err}
+	}
+	err = sk.Write(name, c, dst)
+	if err == nil {
+		err = sk.Flush()
+	}
+	return dst.Key(), err
+}
+
+//watch closes ch once ctx is done to unblock a continuous feed waiting for data, it stops watching when done is closed
+func watch(ctx context.Context, ch couchdb.IChanges, done <-chan struct{}) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			ch.Close()
+		case <-done:
+		}
+	}()
+}
+
+//finish returns the error which interrupted the feed, when the feed ended instead its last_seq is checkpointed
+func finish(name string, ch couchdb.IChanges, seq string, ended bool, cp checkpoint.Checkpointer) (string, error) {
+	if _, err := ch.Get(); err != nil && err != io.EOF {
+		return seq, err
+	}
+	if ended {
+		seq = advance(name, ch, seq, cp)
+	}
+	return seq, nil
+}
+
+//drain handles changes until the feed ends or ctx is done and returns the latest checkpoint along with the error which interrupted the feed.
+//The change in flight is applied and checkpointed before returning, unless ctx is done while its retries back off.
+func drain(ctx context.Context, name string, ch couchdb.IChanges, seq string, cp checkpoint.Checkpointer, dl deadletter.Letters, sk sink.Sink) (string, error) {
+	defer ch.Close()
+	done := make(chan struct{})
+	defer close(done)
+	watch(ctx, ch, done)
+	ended := false
+	for ctx.Err() == nil {
+		if !ch.Next() {
+			ended = true
+			break
+		}
+		c, _ := ch.Get()
+		metrics.ChangesFetched.WithLabelValues(name).Inc()
+		start := time.Now()
+		var key string
+		err := policy.Do(ctx, func() (err error) {
+			key, err = apply(name, c, sk)
+			return err
+		})
+		if err != nil && errors.Is(err, ctx.Err()) {
+			//shutting down during an outage, the change is applied again after restart
+			return seq, err
+		}
+		skipped := err == errSkip
+		if skipped {
+			err = nil
+		}
+		if err != nil {
+			var de decodeError
+			if errors.As(err, &de) {
+				metrics.Failures.WithLabelValues(name, metrics.ReasonDecode).Inc()
+			} else {
+				metrics.Failures.WithLabelValues(name, metrics.ReasonSink).Inc()
+			}
+		}
+		//sink outages stop the pipeline without checkpointing, only bad documents become dead letters
+		if err != nil && !poison(err) {
+			failOnError(err, "Failed to apply "+c.ID)
+		}
+		seq = string(c.Seq)
+		fields := []interface{}{"pipeline", name, "doc_id", c.ID, "key", key, "seq", applog.Seq(seq), "duration", time.Since(start)}
+		if err != nil {
+			slog.Warn("cannot apply document, record dead letter", append(fields, "error", err)...)
+			failOnError(dl.Put(name, c, err), "Failed to record dead letter "+c.ID)
+		} else if skipped {
+			slog.Info("document skipped", fields...)
+			err = errSkip
+		} else {
+			slog.Info("document applied", fields...)
+			err = errors.New("Success")
+		}
+		err = cp.Update(seq, c.ID, err)
+		if err != nil {
+			metrics.Failures.WithLabelValues(name, metrics.ReasonCheckpoint).Inc()
+			slog.Error("cannot update checkpoint", "pipeline", name, "doc_id", c.ID, "seq", applog.Seq(seq), "error", err)
+		} else {
+			metrics.SetCheckpoint(name, seq)
+			monitor.Beat(name)
+		}
+	}
+	return finish(name, ch, seq, ended, cp)
+}
+
+//drainBatch handles changes like drain, but applies up to p.Batch changes along with the checkpoint in one transaction,
+//so a crash never leaves applied changes without their checkpoint.
+//A batch is cut short when no change arrives for p.Linger milliseconds, and is retried as a whole on transient errors.
+func drainBatch(ctx context.Context, name string, ch couchdb.IChanges, seq string, p config.Pipeline, lg *logger.Logger, dl *deadletter.Store, m *sink.MySQL) (string, error) {
+	defer ch.Close()
+	done := make(chan struct{})
+	defer close(done)
+	watch(ctx, ch, done)
+	changes := make(chan couchdb.Change)
+	go func() {
+		defer close(changes)
+		for ch.Next() {
+			c, _ := ch.Get()
+			select {
+			case changes <- *c:
+			case <-done:
+				return
+			}
+		}
+	}()
+	linger := time.Duration(p.Linger) * time.Millisecond
+	batch := make([]couchdb.Change, 0, p.Batch)
+	open := true
+	for open {
+		c, ok := <-changes
+		if !ok {
+			break
+		}
+		batch = append(batch[:0], c)
+		timer := time.NewTimer(linger)
+	collect:
+		for len(batch) < p.Batch {
+			select {
+			case c, ok := <-changes:
+				if !ok {
+					open = false
+					break collect
+				}
+				batch = append(batch, c)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		metrics.ChangesFetched.WithLabelValues(name).Add(float64(len(batch)))
+		start := time.Now()
+		err := policy.Do(ctx, func() error {
+			return applyBatch(name, batch, lg, dl, m)
+		})
+		if err != nil && errors.Is(err, ctx.Err()) {
+			//shutting down during an outage, the batch is applied again after restart
+			return seq, err
+		}
+		if err != nil {
+			reason := metrics.ReasonSink
+			var be batchError
+			if errors.As(err, &be) {
+				reason = be.reason
+			}
+			metrics.Failures.WithLabelValues(name, reason).Inc()
+			failOnError(err, "Failed to apply batch of "+name)
+		}
+		seq = string(batch[len(batch)-1].Seq)
+		slog.Info("batch applied", "pipeline", name, "changes", len(batch), "seq", applog.Seq(seq), "duration", time.Since(start))
+		metrics.SetCheckpoint(name, seq)
+		monitor.Beat(name)
+	}
+	//the reader has stopped, the feed is exhausted
+	return finish(name, ch, seq, true, lg)
+}
+
+//batchError marks errors of a batch which are not counted as sink failures, reason is a metrics reason
+type batchError struct {
+	reason string
+	error
+}
+
+func (e batchError) Unwrap() error {
+	return e.error
+}
+
+//applyBatch applies changes, records dead letters and writes the checkpoint in one transaction.
+//Failures of the checkpoint are returned as batchError, all others are sink failures.
+func applyBatch(name string, batch []couchdb.Change, lg *logger.Logger, dl *deadletter.Store, m *sink.MySQL) error {
+	b, err := m.Begin()
+	if err != nil {
+		return err
+	}
+	defer b.Rollback()
+	dltx := dl.WithTx(b.Tx())
+	var last error
+	//failures are only counted once the batch is committed, attempts which roll back are retried
+	failures := make([]string, 0)
+	for i := range batch {
+		c := &batch[i]
+		dst, err := decoders[name](c.Doc)
+		if err == errSkip {
+			slog.Debug("document skipped", "pipeline", name, "doc_id", c.ID, "seq", applog.Seq(string(c.Seq)))
+			last = err
+			continue
+		}
+		if err != nil {
+			err = decodeError{err}
+			failures = append(failures, metrics.ReasonDecode)
+		} else {
+			err = b.Write(name, c, dst)
+			if err != nil && !poison(err) {
+				return err
+			}
+			if err != nil {
+				failures = append(failures, metrics.ReasonSink)
+			}
+		}
+		if err != nil {
+			slog.Warn("cannot apply document, record dead letter", "pipeline", name, "doc_id", c.ID, "seq", applog.Seq(string(c.Seq)), "error", err)
+			if err := dltx.Put(name, c, err); err != nil {
+				return err
+			}
+			last = err
+		} else {
+			slog.Debug("document applied", "pipeline", name, "doc_id", c.ID, "key", dst.Key(), "seq", applog.Seq(string(c.Seq)))
+			last = errors.New("Success")
+		}
+	}
+	c := batch[len(batch)-1]
+	err = lg.UpdateTx(b.Tx(), string(c.Seq), c.ID, last)
+	if err != nil {
+		return batchError{metrics.ReasonCheckpoint, err}
+	}
+	err = b.Commit()
+	if err == nil {
+		for _, reason := range failures {
+			metrics.Failures.WithLabelValues(name, reason).Inc()
+		}
+	}
+	return err
+}
+
+//redrive applies selected dead letters again, all of them when no id is given
+func redrive(args []string) {
+	ids, err := deadletter.ParseIDs(args)
+	failOnError(err, "Invalid dead letter id")
+	var db *sql.DB
+	if cfg.Sink.Type == "mysql" || cfg.DeadLetter.Type == "mysql" {
+		lg, err := logger.New(cfg.MySQL, "order_seq")
+		failOnError(err, "Failed to open database")
+		defer lg.Close()
+		db = lg.DB()
+	}
+	dl, err := deadLetters(db)
+	failOnError(err, "Failed to open dead letters")
+	letters, err := dl.List(ids)
+	failOnError(err, "Failed to list dead letters")
+	//every pipeline may publish to its own exchange or topic
+	sinks := make(map[string]sink.Sink)
+	for _, l := range letters {
+		if _, ok := decoders[l.Pipeline]; !ok {
+			slog.Warn("unknown pipeline of dead letter", "id", l.ID, "pipeline", l.Pipeline)
+			continue
+		}
+		sk, ok := sinks[l.Pipeline]
+		if !ok {
+			sk, err = sink.New(cfg.Pipelines[l.Pipeline].Route(cfg.Sink), db)
+			failOnError(err, "Failed to create sink")
+			err = sk.Open()
+			failOnError(err, "Failed to open sink")
+			defer sk.Close()
+			sinks[l.Pipeline] = sk
+		}
+		err = policy.Do(context.Background(), func() (err error) {
+			_, err = apply(l.Pipeline, l.Change(), sk)
+			return err
+		})
+		if err == nil || err == errSkip {
+			slog.Info("dead letter redriven", "id", l.ID, "pipeline", l.Pipeline, "doc_id", l.DocID, "skipped", err == errSkip)
+			err = dl.Resolve(l.ID)
+		} else {
+			slog.Warn("cannot redrive dead letter", "id", l.ID, "pipeline", l.Pipeline, "doc_id", l.DocID, "error", err)
+			err = dl.Retry(l.ID, err)
+		}
+		if err != nil {
+			slog.Error("cannot update dead letter", "id", l.ID, "error", err)
 		}
 	}
 }
 
 func main() {
-	pretty.Println("GOOS:", runtime.GOOS, "GOARCH:", runtime.GOARCH)
-	pretty.Println("CouchDB to MySQL", VERSION)
-	initDB = (len(os.Args) == 2) && (os.Args[1] == "--init")
-	forever(handleOrders)
+	cfgPath := flag.String("config", config.DefaultPath, "path of configuration file")
+	flag.BoolVar(&initDB, "init", false, "drop and create tables")
+	redriveDL := flag.Bool("redrive", false, "apply dead letters again, ids of dead letters follow, all when none is given")
+	flag.Parse()
+	loaded, err := config.Load(*cfgPath)
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(2)
+	}
+	cfg = loaded
+	err = applog.Setup(cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		slog.Error("invalid log configuration", "error", err)
+		os.Exit(2)
+	}
+	slog.Info("CouchDB to MySQL", "version", VERSION, "goos", runtime.GOOS, "goarch", runtime.GOARCH)
+	policy = retry.New(cfg.Retry)
+	monitor = health.New(time.Duration(cfg.HTTP.Staleness)*time.Millisecond, time.Duration(cfg.HTTP.ReadyStaleness)*time.Millisecond)
+	if *redriveDL {
+		redrive(flag.Args())
+		return
+	}
+	if initDB {
+		initDatabase()
+	}
+	if len(cfg.HTTP.Listen) > 0 {
+		mux := http.NewServeMux()
+		metrics.Handle(mux)
+		monitor.Handle(mux)
+		go func() {
+			slog.Info("serve HTTP", "listen", cfg.HTTP.Listen)
+			failOnError(http.ListenAndServe(cfg.HTTP.Listen, mux), "Failed to serve HTTP")
+		}()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	var wg sync.WaitGroup
+	run := func(fn func(ctx context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forever(ctx, fn)
+		}()
+	}
+	if shifts, ok := cfg.Pipelines["shifts"]; ok {
+		run(follow("shifts", shifts, "shift_seq"))
+	}
+	run(follow("orders", cfg.Pipelines["orders"], "order_seq"))
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down, waiting for pipelines to finish")
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		slog.Info("stopped")
+	case <-time.After(shutdownTimeout):
+		slog.Error("pipelines did not stop in time", "timeout", shutdownTimeout)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	//ChangesFetched counts changes read from CouchDB
+	ChangesFetched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "couch2mq",
+		Name:      "changes_fetched_total",
+		Help:      "Changes read from CouchDB change feeds.",
+	}, []string{"pipeline"})
+	//Applied counts documents committed into MySQL by operation
+	Applied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "couch2mq",
+		Name:      "documents_applied_total",
+		Help:      "Documents committed into MySQL by operation, e.g. insert, update and delete.",
+	}, []string{"operation"})
+	//Failures counts failures by reason
+	Failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "couch2mq",
+		Name:      "failures_total",
+		Help:      "Failures by pipeline and reason.",
+	}, []string{"pipeline", "reason"})
+	//TxDuration observes how long MySQL transactions take
+	TxDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "couch2mq",
+		Name:      "transaction_duration_seconds",
+		Help:      "Duration of MySQL transactions applying documents.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	//Pending is the number of changes CouchDB reported as not yet sent
+	Pending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "couch2mq",
+		Name:      "pending_changes",
+		Help:      "Pending count reported by CouchDB change feeds.",
+	}, []string{"pipeline"})
+	//Checkpoint is the numeric prefix of the latest checkpoint
+	Checkpoint = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "couch2mq",
+		Name:      "checkpoint_seq",
+		Help:      "Numeric prefix of the latest checkpointed sequence.",
+	}, []string{"pipeline"})
+)
+
+//Failure reasons
+const (
+	ReasonDecode     = "decode"
+	ReasonSink       = "sink"
+	ReasonCheckpoint = "checkpoint"
+	ReasonFeed       = "feed"
+)
+
+func init() {
+	prometheus.MustRegister(ChangesFetched, Applied, Failures, TxDuration, Pending, Checkpoint)
+}
+
+//SetCheckpoint records the numeric prefix of seq, seqs without one are ignored
+func SetCheckpoint(pipeline string, seq string) {
+	s := strings.SplitN(seq, "-", 2)
+	if n, err := strconv.ParseFloat(s[0], 64); err == nil {
+		Checkpoint.WithLabelValues(pipeline).Set(n)
+	}
+}
+
+//ObserveTx records the duration of a transaction started at start
+func ObserveTx(start time.Time) {
+	TxDuration.Observe(time.Since(start).Seconds())
+}
+
+//Handle registers /metrics on mux
+func Handle(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.Handler())
+}
@@ -4,12 +4,11 @@ import (
 	"bytes"
 	"database/sql"
 	"fmt"
+	"log/slog"
 	"reflect"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/kr/pretty"
 )
 
 // Sequence represents update sequence ID. It is string in 2.0, integer in previous versions.
@@ -26,7 +25,20 @@ func (id *ID) UnmarshalJSON(data []byte) error {
 
 const ocTimeLayout = "2006-01-02 15:04:05"
 
-func toList(data interface{}, useFields []string) (string, []string, []string) {
+//Querier runs lookups of Do, it is satisfied by both *sql.DB and *sql.Tx
+type Querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+//Document is a CouchDB document which can be put into OC
+type Document interface {
+	Key() string
+	Do(db Querier) []Statement
+	//Op returns the operation chosen by Do, e.g. insert, update or delete
+	Op() string
+}
+
+func toList(data interface{}, useFields []string) (string, []string, []interface{}) {
 	useFieldsCache := make(map[string]bool)
 	if nil != useFields {
 		for _, f := range useFields {
@@ -38,7 +50,7 @@ func toList(data interface{}, useFields []string) (string, []string, []string) {
 	var tableName string
 	var fieldName string
 	sqlField := make([]string, 0, typ.NumField())
-	valField := make([]string, 0, typ.NumField())
+	valField := make([]interface{}, 0, typ.NumField())
 	for i := 0; i < typ.NumField(); i++ {
 		tfld := typ.Field(i)
 		vfld := val.Field(i)
@@ -59,7 +71,7 @@ func toList(data interface{}, useFields []string) (string, []string, []string) {
 				} else {
 					sqlField = append(sqlField, tfld.Name)
 				}
-				valField = append(valField, strconv.FormatInt(vfld.Int(), 10))
+				valField = append(valField, vfld.Int())
 			}
 		case reflect.String:
 			{
@@ -69,7 +81,7 @@ func toList(data interface{}, useFields []string) (string, []string, []string) {
 				} else {
 					sqlField = append(sqlField, tfld.Name)
 				}
-				valField = append(valField, "'"+vfld.String()+"'")
+				valField = append(valField, vfld.String())
 			}
 		case reflect.Struct:
 			{
@@ -80,7 +92,7 @@ func toList(data interface{}, useFields []string) (string, []string, []string) {
 					} else {
 						sqlField = append(sqlField, tfld.Name)
 					}
-					valField = append(valField, "'"+vfld.Interface().(time.Time).Format(ocTimeLayout)+"'")
+					valField = append(valField, vfld.Interface().(time.Time).Format(ocTimeLayout))
 				} else {
 					panic("Cannot handle field type " + tfld.Name + ":" + tfld.Type.String())
 				}
@@ -92,57 +104,67 @@ func toList(data interface{}, useFields []string) (string, []string, []string) {
 	return tableName, sqlField, valField
 }
 
-func assignmentList(data interface{}, useFields []string) (string, []string) {
+func assignmentList(data interface{}, useFields []string) (string, []string, []interface{}) {
 	tableName, sqlField, valField := toList(data, useFields)
 	whereField := make([]string, 0, len(sqlField))
 	for i := 0; i < len(sqlField); i++ {
-		whereField = append(whereField, sqlField[i]+"="+valField[i])
+		whereField = append(whereField, sqlField[i]+"=?")
 	}
-	return tableName, whereField
+	return tableName, whereField, valField
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+//Statement is a SQL statement with placeholders along with its arguments
+type Statement struct {
+	Query string
+	Args  []interface{}
 }
 
 //Struct2SQL is a dummy type to create a name space
 type Struct2SQL int
 
 //Insert create a new record in database table
-func (s Struct2SQL) Insert(data interface{}) string {
+func (s Struct2SQL) Insert(data interface{}) (string, []interface{}) {
 	tableName, sqlField, valField := toList(data, nil)
 	sqlStr := "(" + strings.Join(sqlField, ",") + ")"
-	valStr := "(" + strings.Join(valField, ",") + ")"
+	valStr := "(" + placeholders(len(valField)) + ")"
 	statement := fmt.Sprintf("INSERT INTO %s %s VALUES %s", tableName, sqlStr, valStr)
 	//pretty.Println(statement)
-	return statement
+	return statement, valField
 }
 
 //Delete delete a record or records from database table
-func (s Struct2SQL) Delete(data interface{}, fields []string) string {
-	tableName, whereField := assignmentList(data, fields)
+func (s Struct2SQL) Delete(data interface{}, fields []string) (string, []interface{}) {
+	tableName, whereField, args := assignmentList(data, fields)
 	whereStr := strings.Join(whereField, " AND ")
 	statement := fmt.Sprintf("DELETE FROM %s WHERE %s", tableName, whereStr)
 	//pretty.Println(statement)
-	return statement
+	return statement, args
 }
 
 //Update update a record or records in database table
-func (s Struct2SQL) Update(data interface{}, where interface{}, fields []string) string {
-	tableName, list := assignmentList(data, nil)
+func (s Struct2SQL) Update(data interface{}, where interface{}, fields []string) (string, []interface{}) {
+	tableName, list, args := assignmentList(data, nil)
 	setStr := strings.Join(list, ",")
-	_, whereField := assignmentList(where, fields)
+	_, whereField, whereArgs := assignmentList(where, fields)
 	whereStr := strings.Join(whereField, " AND ")
 	statement := fmt.Sprintf("UPDATE %s SET %s WHERE %s", tableName, setStr, whereStr)
 	//pretty.Println(statement)
-	return statement
+	return statement, append(args, whereArgs...)
 }
 
 //Select query database table
-func (s Struct2SQL) Select(data interface{}, where interface{}, fields []string) string {
+func (s Struct2SQL) Select(data interface{}, where interface{}, fields []string) (string, []interface{}) {
 	tableName, field, _ := toList(data, nil)
-	_, whereField := assignmentList(where, fields)
-	whereStr := strings.Join(whereField, ", AND ")
+	_, whereField, args := assignmentList(where, fields)
+	whereStr := strings.Join(whereField, " AND ")
 	fieldStr := strings.Join(field, ", ")
 	statement := fmt.Sprintf("SELECT %s FROM %s WHERE %s", fieldStr, tableName, whereStr)
 	//pretty.Println(statement)
-	return statement
+	return statement, args
 }
 
 //Discount correspondes to order_discount table
@@ -561,6 +583,12 @@ type OrderJSON struct {
 	OcMsg      interface{} `json:"oc_msg, omitempty"`
 	Order      JOrder      `json:"order, omitempty"`
 	AmountInfo JAmountInfo `json:"amountInfo, omitempty"`
+	op         string
+}
+
+//Key returns the order id which identifies the document downstream
+func (od *OrderJSON) Key() string {
+	return string(od.Order.OrderInfo.OrderID)
 }
 
 //OrderWithAmountInfo
@@ -579,50 +607,70 @@ func (od *OrderJSON) OrderWithAmountInfo() Order {
 }
 
 //Insert generate an array of SQL statements for insert a new order into database
-func (od *OrderJSON) Insert() []string {
+func (od *OrderJSON) Insert() []Statement {
+	master := od.OrderWithAmountInfo()
+	ret := make([]Statement, 0, 30)
+	var stmt Struct2SQL
+	q, args := stmt.Insert(master)
+	ret = append(ret, Statement{q, args})
+	return append(ret, od.insertItems()...)
+}
+
+//insertItems generate SQL statements for insert discounts, details and meals of an order
+func (od *OrderJSON) insertItems() []Statement {
 	detail := od.Order.genDetail()
 	discount := od.Order.genDiscount()
 	meal := od.Order.genMeal()
-	master := od.OrderWithAmountInfo()
-	ret := make([]string, 0, 30)
+	ret := make([]Statement, 0, 30)
 	var stmt Struct2SQL
-	ret = append(ret, stmt.Insert(master))
 	for _, tmp := range discount {
-		ret = append(ret, stmt.Insert(tmp))
+		q, args := stmt.Insert(tmp)
+		ret = append(ret, Statement{q, args})
 	}
 	for _, tmp := range detail {
-		ret = append(ret, stmt.Insert(tmp))
+		q, args := stmt.Insert(tmp)
+		ret = append(ret, Statement{q, args})
 	}
 	for _, tmp := range meal {
-		ret = append(ret, stmt.Insert(tmp))
+		q, args := stmt.Insert(tmp)
+		ret = append(ret, Statement{q, args})
 	}
 	return ret
+}
 
+//deleteItems generate SQL statements to delete discounts, details and meals of an order
+func (od *OrderJSON) deleteItems() []Statement {
+	id := string(od.Order.OrderInfo.OrderID)
+	ret := make([]Statement, 0, 3)
+	ret = append(ret, Statement{"DELETE FROM order_detail WHERE orderId=?", []interface{}{id}})
+	ret = append(ret, Statement{"DELETE FROM order_discount WHERE orderId=?", []interface{}{id}})
+	ret = append(ret, Statement{"DELETE FROM order_meal_detail WHERE orderId=?", []interface{}{id}})
+	return ret
 }
 
 //Delete generate SQL statements to delete an order from database
-func (od *OrderJSON) Delete() []string {
-	ret := make([]string, 0, 4)
-	ret = append(ret, fmt.Sprintf("DELETE FROM order_master WHERE orderId='%s'", od.Order.OrderInfo.OrderID))
-	ret = append(ret, fmt.Sprintf("DELETE FROM order_detail WHERE orderId='%s'", od.Order.OrderInfo.OrderID))
-	ret = append(ret, fmt.Sprintf("DELETE FROM order_discount WHERE orderId='%s'", od.Order.OrderInfo.OrderID))
-	ret = append(ret, fmt.Sprintf("DELETE FROM order_meal_detail WHERE orderId='%s'", od.Order.OrderInfo.OrderID))
-	return ret
+func (od *OrderJSON) Delete() []Statement {
+	id := string(od.Order.OrderInfo.OrderID)
+	ret := make([]Statement, 0, 4)
+	ret = append(ret, Statement{"DELETE FROM order_master WHERE orderId=?", []interface{}{id}})
+	return append(ret, od.deleteItems()...)
 }
 
-//Update generate SQL statements to update an existing order in database
-func (od *OrderJSON) Update() []string {
+//Update generate SQL statements to update an existing order in database, items of the order are replaced
+func (od *OrderJSON) Update() []Statement {
 	master := od.OrderWithAmountInfo()
-	ret := make([]string, 0, 30)
+	ret := make([]Statement, 0, 30)
 	var stmt Struct2SQL
 	fd := make([]string, 0, 1)
 	fd = append(fd, "orderId")
-	ret = append(ret, stmt.Update(master, Order{orderId: string(od.Order.OrderInfo.OrderID)}, fd))
-	return ret
+	q, args := stmt.Update(master, Order{orderId: string(od.Order.OrderInfo.OrderID)}, fd)
+	ret = append(ret, Statement{q, args})
+	ret = append(ret, od.deleteItems()...)
+	return append(ret, od.insertItems()...)
 }
 
 //Exists return true if order alread exists in database
-func (od *OrderJSON) Exists(db *sql.DB) (bool, error) {
+func (od *OrderJSON) Exists(db Querier) (bool, error) {
 	//rows, err := db.Query("SELECT COUNT(*) FROM order_master WHERE orderId=?", od.OrderID)
 	rows, err := db.Query("SELECT COUNT(*) FROM order_master WHERE orderId=?", string(od.Order.OrderInfo.OrderID))
 	if err == nil {
@@ -639,20 +687,28 @@ func (od *OrderJSON) Exists(db *sql.DB) (bool, error) {
 }
 
 //Do put JSON order to OC
-func (od *OrderJSON) Do(db *sql.DB) []string {
+func (od *OrderJSON) Do(db Querier) []Statement {
 	if od.Deleted {
-		pretty.Println("Delete", od.Order.OrderInfo.OrderID)
+		od.op = "delete"
+		slog.Info("apply order", "doc_id", od.ID, "order_id", od.Key(), "op", od.op)
 		return od.Delete()
 	}
 	e, _ := od.Exists(db)
 	if e {
-		pretty.Println("Update", od.Order.OrderInfo.OrderID)
+		od.op = "update"
+		slog.Info("apply order", "doc_id", od.ID, "order_id", od.Key(), "op", od.op)
 		return od.Update()
 	}
-	pretty.Println("Insert", od.Order.OrderInfo.OrderID)
+	od.op = "insert"
+	slog.Info("apply order", "doc_id", od.ID, "order_id", od.Key(), "op", od.op)
 	return od.Insert()
 }
 
+//Op returns the operation chosen by Do
+func (od *OrderJSON) Op() string {
+	return od.op
+}
+
 //JOtherIncomeItem is the item in the list of other income of shift record
 type JOtherIncomeItem struct {
 	KindName    string `json:"kindName"`
@@ -727,4 +783,188 @@ type ShiftJSON struct {
 	ID      string     `json:"_id"`
 	REV     string     `json:"_rev"`
 	Data    JShiftData `json:"data"`
+	op      string
+}
+
+//Shift correspondes to shift_master
+type Shift struct {
+	shiftId          string `oc:"shift_master"`
+	storeId          string
+	storeName        string
+	operaterName     string
+	machineId        string
+	printerName      string
+	isPost           int
+	PrinterTime      time.Time `field:"printerTime"`
+	StartTime        time.Time `field:"startTime"`
+	EndTime          time.Time `field:"endTime"`
+	orderNum         int
+	total            int
+	mainIncome       int
+	otherIncome      int
+	netIncome        int
+	discount         int
+	discart          int
+	shouldMoy        int
+	totalCash        int
+	crossDateTime    string
+	refundTimes      int
+	refund           int
+	allGift          int
+	disOutMoney      int
+	inOrderNum       int
+	inOrderMoney     int
+	outOrderNum      int
+	outOrderMoney    int
+	erpSid           string
+	posId            string
+	posType          string
+	posStart         int
+	posEnd           int
+	posUser          string
+	operatingIncome  int
+	totalOrders      int
+	erpDiscount      int
+	erpTotalCash     int
+	gift             int
+	couponOvercharge int
+	erpRefund        int
+	erpRefundTimes   int
+	posRecordsNo     int
+	CreateTime       time.Time `field:"createTime"`
+}
+
+//ShiftIncome correspondes to shift_other_income
+type ShiftIncome struct {
+	shiftId     string `oc:"shift_other_income"`
+	kindName    string
+	number      string
+	totalAmount int
+}
+
+//ShiftPayment correspondes to shift_payment
+type ShiftPayment struct {
+	shiftId string `oc:"shift_payment"`
+	payType string
+	amount  int
+}
+
+//ShiftOrder correspondes to shift_order
+type ShiftOrder struct {
+	shiftId string `oc:"shift_order"`
+	orderId string
+}
+
+func (sh *ShiftJSON) genShift() Shift {
+	ret := Shift{}
+	ret.shiftId = sh.ID
+	ret.storeId = sh.Data.StoreID
+	ret.storeName = sh.Data.StoreName
+	ret.operaterName = sh.Data.OperaterName
+	ret.machineId = sh.Data.MachineID
+	ret.printerName = sh.Data.PrinterName
+	ret.isPost = sh.Data.IsPost
+	ret.PrinterTime = sh.Data.PrinterTime.Time
+	ret.StartTime = sh.Data.StartTime.Time
+	ret.EndTime = sh.Data.EndTime.Time
+	ret.orderNum = sh.Data.OrderNum
+	ret.total = sh.Data.Total
+	ret.mainIncome = sh.Data.MainIncome
+	ret.otherIncome = sh.Data.OtherIncome
+	ret.netIncome = sh.Data.NetIncome
+	ret.discount = sh.Data.Discount
+	ret.discart = sh.Data.Discart
+	ret.shouldMoy = sh.Data.ShouldMoy
+	ret.totalCash = sh.Data.TotalCash
+	ret.crossDateTime = sh.Data.CrossDateTime
+	ret.refundTimes = sh.Data.RefundTimes
+	ret.refund = sh.Data.Refund
+	ret.allGift = sh.Data.AllGift
+	ret.disOutMoney = sh.Data.DisOutMoney
+	ret.inOrderNum = sh.Data.InOrder.Num
+	ret.inOrderMoney = sh.Data.InOrder.Money
+	ret.outOrderNum = sh.Data.OutOrder.Num
+	ret.outOrderMoney = sh.Data.OutOrder.Money
+	ret.erpSid = sh.Data.ERPData.SID
+	ret.posId = sh.Data.ERPData.PosID
+	ret.posType = sh.Data.ERPData.PosType
+	ret.posStart = int(sh.Data.ERPData.PosStart)
+	ret.posEnd = int(sh.Data.ERPData.PosEnd)
+	ret.posUser = sh.Data.ERPData.PosUser
+	ret.operatingIncome = sh.Data.ERPData.OperatingIncome
+	ret.totalOrders = sh.Data.ERPData.TotalOrders
+	ret.erpDiscount = sh.Data.ERPData.Discount
+	ret.erpTotalCash = sh.Data.ERPData.TotalCash
+	ret.gift = sh.Data.ERPData.Gift
+	ret.couponOvercharge = sh.Data.ERPData.CouponOvercharge
+	ret.erpRefund = sh.Data.ERPData.Refund
+	ret.erpRefundTimes = sh.Data.ERPData.RefundTimes
+	ret.posRecordsNo = sh.Data.ERPData.PosRecordsNo
+	ret.CreateTime = time.Now()
+	return ret
+}
+
+//Key returns the document id which identifies the shift downstream
+func (sh *ShiftJSON) Key() string {
+	return sh.ID
+}
+
+//Delete generate SQL statements to delete a shift from database
+func (sh *ShiftJSON) Delete() []Statement {
+	ret := make([]Statement, 0, 4)
+	ret = append(ret, Statement{"DELETE FROM shift_master WHERE shiftId=?", []interface{}{sh.ID}})
+	ret = append(ret, Statement{"DELETE FROM shift_other_income WHERE shiftId=?", []interface{}{sh.ID}})
+	ret = append(ret, Statement{"DELETE FROM shift_payment WHERE shiftId=?", []interface{}{sh.ID}})
+	ret = append(ret, Statement{"DELETE FROM shift_order WHERE shiftId=?", []interface{}{sh.ID}})
+	return ret
+}
+
+//Insert generate SQL statements to insert a shift into database
+func (sh *ShiftJSON) Insert() []Statement {
+	ret := make([]Statement, 0, 30)
+	var stmt Struct2SQL
+	q, args := stmt.Insert(sh.genShift())
+	ret = append(ret, Statement{q, args})
+	for _, item := range sh.Data.OtherStatistics {
+		q, args = stmt.Insert(ShiftIncome{
+			shiftId:     sh.ID,
+			kindName:    item.KindName,
+			number:      item.Number,
+			totalAmount: item.TotalAmount,
+		})
+		ret = append(ret, Statement{q, args})
+	}
+	for _, item := range sh.Data.ERPData.PaymentCollect {
+		q, args = stmt.Insert(ShiftPayment{
+			shiftId: sh.ID,
+			payType: item.Type,
+			amount:  item.Amount,
+		})
+		ret = append(ret, Statement{q, args})
+	}
+	for _, id := range sh.Data.ERPData.OrderList {
+		q, args = stmt.Insert(ShiftOrder{
+			shiftId: sh.ID,
+			orderId: id,
+		})
+		ret = append(ret, Statement{q, args})
+	}
+	return ret
+}
+
+//Do put JSON shift to OC, an existing shift is replaced as a whole
+func (sh *ShiftJSON) Do(db Querier) []Statement {
+	if sh.Deleted {
+		sh.op = "delete"
+		slog.Info("apply shift", "doc_id", sh.ID, "store_id", sh.Data.StoreID, "op", sh.op)
+		return sh.Delete()
+	}
+	sh.op = "replace"
+	slog.Info("apply shift", "doc_id", sh.ID, "store_id", sh.Data.StoreID, "op", sh.op)
+	return append(sh.Delete(), sh.Insert()...)
+}
+
+//Op returns the operation chosen by Do
+func (sh *ShiftJSON) Op() string {
+	return sh.op
 }
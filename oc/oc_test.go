@@ -0,0 +1,52 @@
+package oc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type remark struct {
+	orderId string `oc:"order_remark"`
+	lineNo  int    `field:"line_no"`
+	text    string
+}
+
+func checkStatement(t *testing.T, query string, args []interface{}, wantQuery string, wantArgs []interface{}) {
+	t.Helper()
+	if strings.Contains(query, "'") {
+		t.Errorf("values leaked into %q", query)
+	}
+	if query != wantQuery {
+		t.Errorf("query is %q, expected %q", query, wantQuery)
+	}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("args are %#v, expected %#v", args, wantArgs)
+	}
+}
+
+func TestStruct2SQLPlaceholders(t *testing.T) {
+	var stmt Struct2SQL
+	r := remark{orderId: "O'Brien", lineNo: 2, text: "no onions'); DROP TABLE order_master; --"}
+	where := remark{orderId: "it's", lineNo: 7}
+
+	q, args := stmt.Insert(r)
+	checkStatement(t, q, args,
+		"INSERT INTO order_remark (orderId,line_no,text) VALUES (?,?,?)",
+		[]interface{}{"O'Brien", int64(2), "no onions'); DROP TABLE order_master; --"})
+
+	q, args = stmt.Update(r, where, []string{"orderId", "lineNo"})
+	checkStatement(t, q, args,
+		"UPDATE order_remark SET orderId=?,line_no=?,text=? WHERE orderId=? AND line_no=?",
+		[]interface{}{"O'Brien", int64(2), "no onions'); DROP TABLE order_master; --", "it's", int64(7)})
+
+	q, args = stmt.Delete(where, []string{"orderId"})
+	checkStatement(t, q, args,
+		"DELETE FROM order_remark WHERE orderId=?",
+		[]interface{}{"it's"})
+
+	q, args = stmt.Select(r, where, []string{"orderId", "lineNo"})
+	checkStatement(t, q, args,
+		"SELECT orderId, line_no, text FROM order_remark WHERE orderId=? AND line_no=?",
+		[]interface{}{"it's", int64(7)})
+}
@@ -0,0 +1,119 @@
+package retry
+
+import (
+	"context"
+	"couch2mq/config"
+	"couch2mq/couchdb"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-sql-driver/mysql"
+	"github.com/streadway/amqp"
+)
+
+//Policy describes how an operation is retried
+type Policy struct {
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	//Jitter is the fraction of backoff which is randomized, between 0 and 1
+	Jitter float64
+}
+
+//New returns the policy described by configuration
+func New(cfg config.Retry) Policy {
+	return Policy{
+		MaxAttempts: cfg.MaxAttempts,
+		BaseBackoff: time.Duration(cfg.BaseBackoff) * time.Millisecond,
+		MaxBackoff:  time.Duration(cfg.MaxBackoff) * time.Millisecond,
+		Jitter:      cfg.Jitter,
+	}
+}
+
+//Backoff returns how long to wait before the given attempt, attempts start at 1
+func (p Policy) Backoff(attempt int) time.Duration {
+	d := p.BaseBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 && d > 0 {
+		spread := time.Duration(float64(d) * p.Jitter)
+		d = d - spread + time.Duration(rand.Int63n(int64(2*spread)+1))
+	}
+	return d
+}
+
+//Do runs fn until it succeeds, fails with an error which is not retryable or runs out of attempts.
+//A backoff is cut short when ctx is done, ctx.Err() is returned then.
+func (p Policy) Do(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !Retryable(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+		d := p.Backoff(attempt)
+		slog.Warn("retry", "attempt", attempt, "backoff", d, "error", err)
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+//Retryable tells whether err is transient, e.g. MySQL deadlock, lock wait timeout, read-only failover,
+//broken connections, CouchDB 5xx, closed AMQP channels or unavailable Kafka brokers
+func Retryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case 1205, 1213, 1040, 1053, 1290, 1836:
+			return true
+		}
+		return false
+	}
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		//the connection or channel is gone, the sink reopens it
+		return true
+	}
+	var kafkaErr sarama.KError
+	if errors.As(err, &kafkaErr) {
+		switch kafkaErr {
+		case sarama.ErrLeaderNotAvailable, sarama.ErrNotLeaderForPartition, sarama.ErrRequestTimedOut,
+			sarama.ErrBrokerNotAvailable, sarama.ErrReplicaNotAvailable, sarama.ErrNetworkException,
+			sarama.ErrNotEnoughReplicas, sarama.ErrNotEnoughReplicasAfterAppend, sarama.ErrKafkaStorageError:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, sarama.ErrOutOfBrokers) || errors.Is(err, sarama.ErrNotConnected) {
+		return true
+	}
+	var httpErr *couchdb.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500 || httpErr.StatusCode == 429
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
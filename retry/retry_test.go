@@ -0,0 +1,147 @@
+package retry
+
+import (
+	"context"
+	"couch2mq/couchdb"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-sql-driver/mysql"
+	"github.com/streadway/amqp"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"lock wait timeout", &mysql.MySQLError{Number: 1205}, true},
+		{"deadlock", &mysql.MySQLError{Number: 1213}, true},
+		{"too many connections", &mysql.MySQLError{Number: 1040}, true},
+		{"read only", &mysql.MySQLError{Number: 1290}, true},
+		{"read only transaction", &mysql.MySQLError{Number: 1836}, true},
+		{"wrapped deadlock", fmt.Errorf("apply: %w", &mysql.MySQLError{Number: 1213}), true},
+		{"duplicate key", &mysql.MySQLError{Number: 1062}, false},
+		{"missing table", &mysql.MySQLError{Number: 1146}, false},
+		{"bad connection", driver.ErrBadConn, true},
+		{"invalid connection", mysql.ErrInvalidConn, true},
+		{"amqp channel closed", amqp.ErrClosed, true},
+		{"kafka leader not available", sarama.ErrLeaderNotAvailable, true},
+		{"kafka not enough replicas", sarama.ErrNotEnoughReplicas, true},
+		{"kafka message too large", sarama.ErrMessageSizeTooLarge, false},
+		{"kafka out of brokers", sarama.ErrOutOfBrokers, true},
+		{"couchdb 500", &couchdb.HTTPError{StatusCode: 500}, true},
+		{"couchdb 503", &couchdb.HTTPError{StatusCode: 503}, true},
+		{"couchdb 429", &couchdb.HTTPError{StatusCode: 429}, true},
+		{"couchdb 404", &couchdb.HTTPError{StatusCode: 404}, false},
+		{"couchdb 401", &couchdb.HTTPError{StatusCode: 401}, false},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"eof", io.EOF, true},
+		{"unexpected eof", io.ErrUnexpectedEOF, true},
+		{"canceled", context.Canceled, false},
+		{"wrapped canceled", fmt.Errorf("get: %w", context.Canceled), false},
+		{"other", errors.New("wrong format"), false},
+	}
+	for _, tt := range tests {
+		if got := Retryable(tt.err); got != tt.want {
+			t.Errorf("%s: Retryable(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := Policy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+	for _, tt := range tests {
+		if got := p.Backoff(tt.attempt); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	p := Policy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.5}
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 150 * time.Millisecond},
+		{3, 200 * time.Millisecond, 600 * time.Millisecond},
+		{10, 500 * time.Millisecond, 1500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 100; i++ {
+			d := p.Backoff(tt.attempt)
+			if d < tt.min || d > tt.max {
+				t.Fatalf("Backoff(%d) = %v, want within [%v, %v]", tt.attempt, d, tt.min, tt.max)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("Backoff(%d) is not randomized", tt.attempt)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	transient := &mysql.MySQLError{Number: 1213}
+	permanent := &mysql.MySQLError{Number: 1062}
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		want     error
+	}{
+		{"success", []error{nil}, 1, nil},
+		{"transient then success", []error{transient, transient, nil}, 3, nil},
+		{"permanent", []error{permanent}, 1, permanent},
+		{"out of attempts", []error{transient, transient, transient, transient}, 3, transient},
+	}
+	p := Policy{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	for _, tt := range tests {
+		attempts := 0
+		err := p.Do(context.Background(), func() error {
+			err := tt.errs[attempts]
+			attempts++
+			return err
+		})
+		if err != tt.want || attempts != tt.attempts {
+			t.Errorf("%s: Do returned %v after %d attempts, want %v after %d", tt.name, err, attempts, tt.want, tt.attempts)
+		}
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	p := Policy{MaxAttempts: 10, BaseBackoff: time.Hour, MaxBackoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err := p.Do(ctx, func() error {
+		attempts++
+		return driver.ErrBadConn
+	})
+	if err != context.Canceled || attempts != 1 {
+		t.Fatalf("Do returned %v after %d attempts, want %v after 1", err, attempts, context.Canceled)
+	}
+}
@@ -0,0 +1,138 @@
+package sink
+
+import (
+	"couch2mq/couchdb"
+	"couch2mq/oc"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/streadway/amqp"
+)
+
+//AMQP publishes changes to a RabbitMQ exchange
+type AMQP struct {
+	url         string
+	exchange    string
+	routingKey  string
+	conn        *amqp.Connection
+	channel     *amqp.Channel
+	confirms    chan amqp.Confirmation
+	returns     chan amqp.Return
+	closed      chan *amqp.Error
+	outstanding int
+}
+
+//NewAMQP returns a sink publishing to exchange, routingKey falls back to document key when it is empty
+func NewAMQP(url string, exchange string, routingKey string) *AMQP {
+	return &AMQP{
+		url:        url,
+		exchange:   exchange,
+		routingKey: routingKey,
+	}
+}
+
+//Open connects to broker and puts the channel into confirm mode
+func (a *AMQP) Open() error {
+	conn, err := amqp.Dial(a.url)
+	if err == nil {
+		ch, err := conn.Channel()
+		if err == nil {
+			err = ch.Confirm(false)
+			if err == nil {
+				a.conn = conn
+				a.channel = ch
+				a.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 128))
+				a.returns = ch.NotifyReturn(make(chan amqp.Return, 128))
+				//the channel is closed along with the connection, so watching it is enough
+				a.closed = ch.NotifyClose(make(chan *amqp.Error, 1))
+				a.outstanding = 0
+				return nil
+			}
+			ch.Close()
+		}
+		conn.Close()
+		return err
+	}
+	return err
+}
+
+//reopen reconnects when the broker closed the channel or the connection, e.g. after a restart
+func (a *AMQP) reopen() error {
+	if a.channel == nil {
+		return a.Open()
+	}
+	select {
+	case err := <-a.closed:
+		slog.Warn("AMQP channel closed, reconnect", "error", err)
+		a.Close()
+		a.channel = nil
+		a.conn = nil
+		return a.Open()
+	default:
+		return nil
+	}
+}
+
+//Write publishes a change as a persistent JSON message with a pipeline header, unroutable messages are returned by the broker
+func (a *AMQP) Write(pipeline string, change *couchdb.Change, doc oc.Document) error {
+	err := a.reopen()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(newMessage(pipeline, change))
+	if err == nil {
+		key := a.routingKey
+		if len(key) == 0 {
+			key = doc.Key()
+		}
+		err = a.channel.Publish(a.exchange, key, true, false, amqp.Publishing{
+			Headers:      amqp.Table{"pipeline": pipeline},
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    change.ID,
+			Body:         body,
+		})
+		if err == nil {
+			a.outstanding++
+		}
+	}
+	return err
+}
+
+//Flush waits until broker confirms all published messages, and fails when one of them was rejected or returned
+func (a *AMQP) Flush() error {
+	var err error
+	for ; a.outstanding > 0; a.outstanding-- {
+		c, ok := <-a.confirms
+		if !ok {
+			a.outstanding = 0
+			return amqp.ErrClosed
+		}
+		if !c.Ack && err == nil {
+			err = fmt.Errorf("AMQP broker rejected message %d", c.DeliveryTag)
+		}
+	}
+	//the broker sends basic.return before the confirmation of an unroutable message
+	for {
+		select {
+		case r := <-a.returns:
+			if err == nil {
+				err = fmt.Errorf("AMQP message %s returned by %s with routing key %s: %d %s", r.MessageId, r.Exchange, r.RoutingKey, r.ReplyCode, r.ReplyText)
+			}
+		default:
+			return err
+		}
+	}
+}
+
+//Close closes channel and connection
+func (a *AMQP) Close() error {
+	if a.channel != nil {
+		a.channel.Close()
+	}
+	if a.conn != nil {
+		return a.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package sink
+
+import (
+	"couch2mq/couchdb"
+	"couch2mq/metrics"
+	"couch2mq/oc"
+	"database/sql"
+	"log/slog"
+	"time"
+)
+
+//Batch writes documents of many changes in one MySQL transaction,
+//every document runs under a savepoint so that a failing one is rolled back alone
+type Batch struct {
+	tx    *sql.Tx
+	start time.Time
+	ops   []string
+}
+
+//Begin starts a batch
+func (m *MySQL) Begin() (*Batch, error) {
+	start := time.Now()
+	tx, err := m.db.Begin()
+	if err == nil {
+		b := Batch{
+			tx:    tx,
+			start: start,
+		}
+		return &b, nil
+	}
+	return nil, err
+}
+
+//Tx returns the transaction of the batch, checkpoints and dead letters written with it are committed atomically
+func (b *Batch) Tx() *sql.Tx {
+	return b.tx
+}
+
+//Write executes statements of a document, they are rolled back to the savepoint when one of them fails.
+//Lookups run in the transaction so that earlier documents of the batch are seen, a revision applied before is skipped.
+func (b *Batch) Write(pipeline string, change *couchdb.Change, doc oc.Document) error {
+	_, err := b.tx.Exec("SAVEPOINT doc")
+	if err == nil {
+		err = b.write(pipeline, change, doc)
+		if err != nil {
+			//a deadlock rolls back the whole transaction, the savepoint is gone then
+			b.tx.Exec("ROLLBACK TO SAVEPOINT doc")
+			return err
+		}
+		_, err = b.tx.Exec("RELEASE SAVEPOINT doc")
+	}
+	return err
+}
+
+func (b *Batch) write(pipeline string, change *couchdb.Change, doc oc.Document) error {
+	skip, err := applied(b.tx, pipeline, change)
+	if err != nil || skip {
+		if skip {
+			b.ops = append(b.ops, "skip")
+		}
+		return err
+	}
+	for _, stmt := range doc.Do(b.tx) {
+		_, err = b.tx.Exec(stmt.Query, stmt.Args...)
+		if err != nil {
+			return err
+		}
+	}
+	err = markApplied(b.tx, pipeline, change)
+	if err == nil {
+		b.ops = append(b.ops, doc.Op())
+	}
+	return err
+}
+
+//Commit commits the batch
+func (b *Batch) Commit() error {
+	err := b.tx.Commit()
+	if err == nil {
+		slog.Debug("commit batch", "documents", len(b.ops), "duration", time.Since(b.start))
+		metrics.ObserveTx(b.start)
+		for _, op := range b.ops {
+			metrics.Applied.WithLabelValues(op).Inc()
+		}
+	}
+	return err
+}
+
+//Rollback discards the batch, it does nothing after Commit
+func (b *Batch) Rollback() error {
+	return b.tx.Rollback()
+}
@@ -0,0 +1,78 @@
+package sink
+
+import (
+	"couch2mq/couchdb"
+	"couch2mq/oc"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+)
+
+//Kafka publishes changes to a Kafka topic keyed by document key
+type Kafka struct {
+	brokers  []string
+	topic    string
+	producer sarama.SyncProducer
+}
+
+//NewKafka returns a sink producing to topic on the given brokers
+func NewKafka(brokers []string, topic string) *Kafka {
+	return &Kafka{
+		brokers: brokers,
+		topic:   topic,
+	}
+}
+
+//NewKafkaProducer returns a sink using an existing producer, e.g. one from sarama/mocks
+func NewKafkaProducer(producer sarama.SyncProducer, topic string) *Kafka {
+	return &Kafka{
+		topic:    topic,
+		producer: producer,
+	}
+}
+
+//Open connects to brokers unless a producer is already given
+func (k *Kafka) Open() error {
+	if k.producer != nil {
+		return nil
+	}
+	cfg := sarama.NewConfig()
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Partitioner = sarama.NewHashPartitioner
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.Idempotent = true
+	cfg.Net.MaxOpenRequests = 1
+	cfg.Version = sarama.V0_11_0_0
+	producer, err := sarama.NewSyncProducer(k.brokers, cfg)
+	if err == nil {
+		k.producer = producer
+	}
+	return err
+}
+
+//Write publishes a change with a pipeline header and returns after the broker acknowledges it
+func (k *Kafka) Write(pipeline string, change *couchdb.Change, doc oc.Document) error {
+	body, err := json.Marshal(newMessage(pipeline, change))
+	if err == nil {
+		_, _, err = k.producer.SendMessage(&sarama.ProducerMessage{
+			Topic:   k.topic,
+			Key:     sarama.StringEncoder(doc.Key()),
+			Value:   sarama.ByteEncoder(body),
+			Headers: []sarama.RecordHeader{{Key: []byte("pipeline"), Value: []byte(pipeline)}},
+		})
+	}
+	return err
+}
+
+//Flush does nothing since every write is acknowledged
+func (k *Kafka) Flush() error {
+	return nil
+}
+
+//Close closes the producer
+func (k *Kafka) Close() error {
+	if k.producer != nil {
+		return k.producer.Close()
+	}
+	return nil
+}
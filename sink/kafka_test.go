@@ -0,0 +1,86 @@
+package sink
+
+import (
+	"couch2mq/couchdb"
+	"couch2mq/oc"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+)
+
+const orderDoc = `{"_id":"order-1","_rev":"2-b","order":{"orderInfo":{"orderid":"100200300"}}}`
+
+func orderChange(t *testing.T) (*couchdb.Change, *oc.OrderJSON) {
+	t.Helper()
+	change := &couchdb.Change{
+		Seq:       "42-g1AAAA",
+		ID:        "order-1",
+		Revisions: []couchdb.Rev{{Revison: "2-b"}},
+		Doc:       json.RawMessage(orderDoc),
+	}
+	var doc oc.OrderJSON
+	if err := json.Unmarshal(change.Doc, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return change, &doc
+}
+
+func TestKafkaWrite(t *testing.T) {
+	change, doc := orderChange(t)
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		if msg.Topic != "orders" {
+			return fmt.Errorf("topic is %s", msg.Topic)
+		}
+		if len(msg.Headers) != 1 || string(msg.Headers[0].Key) != "pipeline" || string(msg.Headers[0].Value) != "orders" {
+			return fmt.Errorf("headers are %v", msg.Headers)
+		}
+		key, err := msg.Key.Encode()
+		if err != nil {
+			return err
+		}
+		if string(key) != "100200300" {
+			return fmt.Errorf("key is %s, expected the order id", key)
+		}
+		value, err := msg.Value.Encode()
+		if err != nil {
+			return err
+		}
+		var m Message
+		if err = json.Unmarshal(value, &m); err != nil {
+			return err
+		}
+		if m.Pipeline != "orders" || m.ID != "order-1" || m.Rev != "2-b" || m.Seq != "42-g1AAAA" || m.Deleted {
+			return fmt.Errorf("unexpected message %s", value)
+		}
+		if string(m.Doc) != orderDoc {
+			return fmt.Errorf("doc is %s", m.Doc)
+		}
+		return nil
+	})
+	k := NewKafkaProducer(producer, "orders")
+	if err := k.Write("orders", change, doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKafkaWriteFailedAck(t *testing.T) {
+	change, doc := orderChange(t)
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageAndFail(sarama.ErrNotEnoughReplicas)
+	k := NewKafkaProducer(producer, "orders")
+	err := k.Write("orders", change, doc)
+	if !errors.Is(err, sarama.ErrNotEnoughReplicas) {
+		t.Fatalf("Write returned %v, expected %v", err, sarama.ErrNotEnoughReplicas)
+	}
+	if err := k.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,128 @@
+package sink
+
+import (
+	"couch2mq/couchdb"
+	"couch2mq/metrics"
+	"couch2mq/oc"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//createApplied keeps the latest applied revision of every document per pipeline, so that replayed changes are skipped.
+//docid is as wide as in order_seq, it is keyed by its SHA-256 since the key would exceed the index size limit.
+const createApplied = `CREATE TABLE IF NOT EXISTS applied_revision (
+  pipeline varchar(50) NOT NULL,
+  docid varchar(2048) NOT NULL,
+  dochash char(64) NOT NULL,
+  rev varchar(64) NOT NULL,
+  seq varchar(2048) NOT NULL,
+  timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (pipeline, dochash)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8`
+
+//docHash returns the key of a document id in applied_revision
+func docHash(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+//generation returns the number before the dash of a revision
+func generation(rev string) int {
+	n, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	return n
+}
+
+//applied reports whether the revision of change, or a later one, has been applied by pipeline already.
+//The row is locked until tx ends.
+func applied(tx *sql.Tx, pipeline string, change *couchdb.Change) (bool, error) {
+	rev := change.Rev()
+	if len(rev) == 0 {
+		return false, nil
+	}
+	var last string
+	err := tx.QueryRow("SELECT rev FROM applied_revision WHERE pipeline=? AND dochash=? FOR UPDATE", pipeline, docHash(change.ID)).Scan(&last)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err == nil {
+		return last == rev || generation(last) > generation(rev), nil
+	}
+	return false, err
+}
+
+//markApplied records the revision of change applied by pipeline in tx
+func markApplied(tx *sql.Tx, pipeline string, change *couchdb.Change) error {
+	rev := change.Rev()
+	if len(rev) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`INSERT INTO applied_revision(pipeline, docid, dochash, rev, seq) VALUES(?,?,?,?,?)
+ON DUPLICATE KEY UPDATE rev=VALUES(rev), seq=VALUES(seq)`, pipeline, change.ID, docHash(change.ID), rev, string(change.Seq))
+	return err
+}
+
+//MySQL puts documents into OC database
+type MySQL struct {
+	db *sql.DB
+}
+
+//NewMySQL returns a sink writing to the given database
+func NewMySQL(db *sql.DB) *MySQL {
+	return &MySQL{db: db}
+}
+
+//Open creates the table of applied revisions, the database is opened by logger
+func (m *MySQL) Open() error {
+	_, err := m.db.Exec(createApplied)
+	return err
+}
+
+//Write executes statements of a document in one transaction, a revision applied before is skipped
+func (m *MySQL) Write(pipeline string, change *couchdb.Change, doc oc.Document) error {
+	start := time.Now()
+	tx, err := m.db.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		skip, err := applied(tx, pipeline, change)
+		if err != nil {
+			return err
+		}
+		op := "skip"
+		if !skip {
+			for _, stmt := range doc.Do(tx) {
+				_, err = tx.Exec(stmt.Query, stmt.Args...)
+				if err != nil {
+					return err
+				}
+			}
+			op = doc.Op()
+			err = markApplied(tx, pipeline, change)
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Commit()
+		if err == nil {
+			slog.Debug("commit transaction", "key", doc.Key(), "op", op, "rev", change.Rev(), "duration", time.Since(start))
+			metrics.ObserveTx(start)
+			metrics.Applied.WithLabelValues(op).Inc()
+		}
+		return err
+	}
+	return err
+}
+
+//Flush does nothing since every write is committed
+func (m *MySQL) Flush() error {
+	return nil
+}
+
+//Close does nothing, the database is closed by logger
+func (m *MySQL) Close() error {
+	return nil
+}
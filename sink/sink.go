@@ -0,0 +1,60 @@
+package sink
+
+import (
+	"couch2mq/config"
+	"couch2mq/couchdb"
+	"couch2mq/oc"
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+//Sink is the destination of CouchDB changes
+type Sink interface {
+	Open() error
+	//Write puts the document of a change made in pipeline
+	Write(pipeline string, change *couchdb.Change, doc oc.Document) error
+	Flush() error
+	Close() error
+}
+
+//Message is the payload published to message queues for every change
+type Message struct {
+	//Pipeline tells consumers sharing a topic or queue which kind of document Doc is
+	Pipeline string           `json:"pipeline"`
+	ID       string           `json:"id"`
+	Seq      couchdb.Sequence `json:"seq"`
+	Rev      string           `json:"rev"`
+	Deleted  bool             `json:"deleted,omitempty"`
+	Doc      json.RawMessage  `json:"doc"`
+}
+
+func newMessage(pipeline string, change *couchdb.Change) Message {
+	msg := Message{
+		Pipeline: pipeline,
+		ID:       change.ID,
+		Seq:      change.Seq,
+		Rev:      change.Rev(),
+		Doc:      change.Doc,
+	}
+	var meta struct {
+		Deleted bool `json:"_deleted"`
+	}
+	if json.Unmarshal(change.Doc, &meta) == nil {
+		msg.Deleted = meta.Deleted
+	}
+	return msg
+}
+
+//New creates the sink selected by configuration
+func New(cfg config.Sink, db *sql.DB) (Sink, error) {
+	switch cfg.Type {
+	case "", "mysql":
+		return NewMySQL(db), nil
+	case "amqp":
+		return NewAMQP(cfg.URL, cfg.Exchange, cfg.RoutingKey), nil
+	case "kafka":
+		return NewKafka(cfg.Brokers, cfg.Topic), nil
+	}
+	return nil, errors.New("Unknown sink type " + cfg.Type)
+}
@@ -0,0 +1,198 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//SSH describes how to reach and authenticate to an SSH bastion
+type SSH struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	//KeyFile is a private key in PEM or OpenSSH format, Passphrase decrypts it
+	KeyFile    string
+	Passphrase string
+	//Agent uses the ssh-agent listening on SSH_AUTH_SOCK
+	Agent bool
+	//KnownHosts is a known_hosts file, Fingerprint is a pinned SHA256:... or MD5 host key fingerprint
+	KnownHosts  string
+	Fingerprint string
+	//Insecure accepts any host key
+	Insecure bool
+	//Keepalive is the interval of keepalive requests, a session not answering within it is redialed
+	Keepalive time.Duration
+	//Jumps are hopped in order before this host is reached
+	Jumps []SSH
+}
+
+//Addr returns host:port of the bastion
+func (s SSH) Addr() string {
+	return net.JoinHostPort(s.Host, fmt.Sprint(s.Port))
+}
+
+//Dial connects to the bastion through its jump hosts
+func (s SSH) Dial() (*ssh.Client, error) {
+	if len(s.Jumps) == 0 {
+		return s.dial(nil)
+	}
+	hops := make([]*ssh.Client, 0, len(s.Jumps))
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hops[i].Close()
+		}
+	}
+	var prev *ssh.Client
+	for _, jump := range s.Jumps {
+		client, err := jump.dial(prev)
+		if err != nil {
+			closeHops()
+			return nil, fmt.Errorf("ssh jump %s: %v", jump.Addr(), err)
+		}
+		hops = append(hops, client)
+		prev = client
+	}
+	client, err := s.dial(prev)
+	if err != nil {
+		closeHops()
+		return nil, err
+	}
+	//the hops live as long as the last client
+	go func() {
+		client.Wait()
+		closeHops()
+	}()
+	return client, nil
+}
+
+//dial connects to this host directly, or through prev when it is not nil
+func (s SSH) dial(prev *ssh.Client) (*ssh.Client, error) {
+	cfg, closer, err := s.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+	if prev == nil {
+		return ssh.Dial("tcp", s.Addr(), cfg)
+	}
+	conn, err := prev.Dial("tcp", s.Addr())
+	if err == nil {
+		c, chans, reqs, err := ssh.NewClientConn(conn, s.Addr(), cfg)
+		if err == nil {
+			return ssh.NewClient(c, chans, reqs), nil
+		}
+		conn.Close()
+		return nil, err
+	}
+	return nil, err
+}
+
+//clientConfig builds the ssh client config, closer releases the agent connection once the handshake is done
+func (s SSH) clientConfig() (*ssh.ClientConfig, func(), error) {
+	closer := func() {}
+	hostKey, err := s.hostKeyCallback()
+	if err != nil {
+		return nil, closer, err
+	}
+	var auth []ssh.AuthMethod
+	if s.Agent {
+		conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return nil, closer, fmt.Errorf("ssh agent: %v", err)
+		}
+		closer = func() { conn.Close() }
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+	if s.KeyFile != "" {
+		signer, err := s.signer()
+		if err != nil {
+			closer()
+			return nil, func() {}, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if s.Password != "" {
+		auth = append(auth, ssh.Password(s.Password))
+	}
+	if len(auth) == 0 {
+		return nil, closer, errors.New("ssh: no authentication method configured")
+	}
+	cfg := &ssh.ClientConfig{
+		User:            s.User,
+		Auth:            auth,
+		HostKeyCallback: hostKey,
+	}
+	return cfg, closer, nil
+}
+
+//signer loads the private key file
+func (s SSH) signer() (ssh.Signer, error) {
+	pem, err := ioutil.ReadFile(s.KeyFile)
+	if err == nil {
+		var signer ssh.Signer
+		if s.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(s.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(pem)
+		}
+		if err == nil {
+			return signer, nil
+		}
+	}
+	return nil, fmt.Errorf("ssh key %s: %v", s.KeyFile, err)
+}
+
+//hostKeyCallback verifies the bastion against the pinned fingerprint and/or known_hosts
+func (s SSH) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	var callbacks []ssh.HostKeyCallback
+	if s.Fingerprint != "" {
+		callbacks = append(callbacks, pinned(s.Fingerprint))
+	}
+	if s.KnownHosts != "" {
+		cb, err := knownhosts.New(s.KnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("ssh known_hosts %s: %v", s.KnownHosts, err)
+		}
+		callbacks = append(callbacks, cb)
+	}
+	if len(callbacks) == 0 {
+		if s.Insecure {
+			return ssh.InsecureIgnoreHostKey(), nil
+		}
+		return nil, errors.New("ssh: no host key verification configured")
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		for _, cb := range callbacks {
+			if err := cb(hostname, remote, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+//pinned accepts only the host key matching fingerprint
+func pinned(fingerprint string) ssh.HostKeyCallback {
+	sha := strings.HasPrefix(fingerprint, "SHA256:")
+	fingerprint = strings.TrimPrefix(fingerprint, "MD5:")
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		actual := ssh.FingerprintLegacyMD5(key)
+		if sha {
+			actual = ssh.FingerprintSHA256(key)
+		}
+		if actual != fingerprint {
+			return fmt.Errorf("ssh: host key of %s is %s, expected %s", hostname, actual, fingerprint)
+		}
+		return nil
+	}
+}
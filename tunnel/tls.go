@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+//TLS describes how the MySQL connection is encrypted
+type TLS struct {
+	//CA is a PEM bundle of trusted roots, system roots are used when it is empty
+	CA string
+	//Cert and Key are the PEM client certificate and its key
+	Cert string
+	Key  string
+	//ServerName overrides the host name checked in the server certificate
+	ServerName string
+	//Verify is full (chain and host name), ca (chain only) or skip
+	Verify string
+}
+
+//register adds the config to the registry of the mysql driver under name, which is the tls DSN parameter.
+//Registering a name again replaces its config.
+func (t TLS) register(name string, dbHost string) error {
+	cfg, err := t.config(dbHost)
+	if err == nil {
+		err = mysql.RegisterTLSConfig(name, cfg)
+	}
+	return err
+}
+
+//config builds the tls config, the server name defaults to dbHost
+func (t TLS) config(dbHost string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: t.ServerName,
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = dbHost
+	}
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, fmt.Errorf("mysql tls ca %s: %v", t.CA, err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mysql tls ca %s: no certificate found", t.CA)
+		}
+	}
+	if t.Cert != "" || t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("mysql tls client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	switch t.Verify {
+	case "", "full":
+	case "ca":
+		//the chain is verified by hand because crypto/tls checks the host name as well
+		roots := cfg.RootCAs
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(raw, roots)
+		}
+	case "skip":
+		cfg.InsecureSkipVerify = true
+	default:
+		return nil, fmt.Errorf("mysql tls verify mode %s is unknown", t.Verify)
+	}
+	return cfg, nil
+}
+
+//verifyChain verifies the server certificate against roots without checking the host name
+func verifyChain(raw [][]byte, roots *x509.CertPool) error {
+	if len(raw) == 0 {
+		return errors.New("mysql tls: no server certificate")
+	}
+	certs := make([]*x509.Certificate, len(raw))
+	for i, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
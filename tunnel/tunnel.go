@@ -2,71 +2,260 @@ package tunnel
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"golang.org/x/crypto/ssh"
 )
 
+//errClosed is returned by Dial once the tunnel is closed
+var errClosed = errors.New("ssh: tunnel closed")
+
+//idleConns is the default number of idle connections of sql.DB
+const idleConns = 2
+
+//viaSSHDialer dials MySQL through the bastion, the ssh client is redialed when the session dies
 type viaSSHDialer struct {
-	client *ssh.Client
+	bastion    SSH
+	mu         sync.Mutex
+	client     *ssh.Client
+	connected  bool
+	reconnects int
+	done       chan struct{}
+	//onDrop is called after a dead ssh client is discarded
+	onDrop func()
+	logger *slog.Logger
 }
 
 //Dial see document of mysql driver
 func (d *viaSSHDialer) Dial(addr string) (net.Conn, error) {
-	return d.client.Dial("tcp", addr)
+	client, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	conn, err = client.Dial("tcp", addr)
+	if err == nil {
+		return conn, nil
+	}
+	//the channel may fail because MySQL refused it, only redial when the session is gone
+	if ping(client, d.bastion.Keepalive) == nil {
+		return nil, err
+	}
+	d.drop(client, err)
+	if client, err = d.connect(); err != nil {
+		return nil, err
+	}
+	return client.Dial("tcp", addr)
+}
+
+//connect returns the current ssh client, dialing the bastion if there is none
+func (d *viaSSHDialer) connect() (*ssh.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	select {
+	case <-d.done:
+		return nil, errClosed
+	default:
+	}
+	if d.client != nil {
+		return d.client, nil
+	}
+	client, err := d.bastion.Dial()
+	if err == nil {
+		if d.connected {
+			d.reconnects++
+			d.logger.Info("ssh tunnel reconnected", "reconnects", d.reconnects)
+		}
+		d.connected = true
+		d.client = client
+		go func() {
+			d.drop(client, client.Wait())
+		}()
+		go d.keepalive(client)
+		return client, nil
+	}
+	d.logger.Warn("ssh dial failed", "reconnects", d.reconnects, "error", err)
+	return nil, err
+}
+
+//drop discards client if it is still the current one
+func (d *viaSSHDialer) drop(client *ssh.Client, err error) {
+	d.mu.Lock()
+	current := d.client == client
+	if current {
+		d.client = nil
+	}
+	reconnects := d.reconnects
+	d.mu.Unlock()
+	client.Close()
+	if current {
+		select {
+		case <-d.done:
+		default:
+			d.logger.Warn("ssh tunnel lost", "reconnects", reconnects, "error", err)
+			if d.onDrop != nil {
+				d.onDrop()
+			}
+		}
+	}
+}
+
+//keepalive pings the bastion until the client dies or the tunnel is closed
+func (d *viaSSHDialer) keepalive(client *ssh.Client) {
+	if d.bastion.Keepalive <= 0 {
+		return
+	}
+	ticker := time.NewTicker(d.bastion.Keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			if err := ping(client, d.bastion.Keepalive); err != nil {
+				d.drop(client, err)
+				return
+			}
+		}
+	}
+}
+
+//close stops keepalives and closes the ssh client
+func (d *viaSSHDialer) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	close(d.done)
+	if d.client != nil {
+		err := d.client.Close()
+		d.client = nil
+		return err
+	}
+	return nil
+}
+
+//ping sends a keepalive@openssh.com request, servers answer it even if they do not know it
+func ping(client *ssh.Client, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(timeout):
+		return errors.New("ssh: keepalive timed out")
+	}
 }
 
 // Tunnel is a mysql connection via SSH tunnel
 type Tunnel struct {
-	Connection *ssh.Client
-	Database   *sql.DB
+	Database *sql.DB
+	dialer   *viaSSHDialer
+	//tlsName is the registered tls config, empty for plain connections
+	tlsName string
 }
 
 //Close close a tunnel
 func (t *Tunnel) Close() error {
-	if t.Connection != nil {
+	if len(t.tlsName) > 0 {
+		defer mysql.DeregisterTLSConfig(t.tlsName)
+	}
+	if t.dialer != nil {
 		t.Database.Close()
-		return t.Connection.Close()
+		return t.dialer.close()
 	}
 	return t.Database.Close()
 }
 
-//Open open a tunnel
-func Open(dbHost string, dbPort int, dbUser string, dbPass string, dbName string) (*Tunnel, error) {
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@mysql+tcp(%s:%d)/%s", dbUser, dbPass, dbHost, dbPort, dbName))
+//Reconnects returns how many times the ssh client was redialed
+func (t *Tunnel) Reconnects() int {
+	if t.dialer != nil {
+		t.dialer.mu.Lock()
+		defer t.dialer.mu.Unlock()
+		return t.dialer.reconnects
+	}
+	return 0
+}
+
+//dsn builds the data source name and returns the name of the registered tls config along with it,
+//tlsConfig is nil for plain connections
+func dsn(name string, network string, dbHost string, dbPort int, dbUser string, dbPass string, dbName string, tlsConfig *TLS) (string, string, error) {
+	s := fmt.Sprintf("%s:%s@%s(%s:%d)/%s", dbUser, dbPass, network, dbHost, dbPort, dbName)
+	if tlsConfig != nil {
+		tlsName := "couch2mq-" + name
+		if err := tlsConfig.register(tlsName, dbHost); err != nil {
+			return "", "", err
+		}
+		return s + "?tls=" + tlsName, tlsName, nil
+	}
+	return s, "", nil
+}
+
+//Open open a tunnel, name identifies it among the tunnels of the process, tlsConfig is nil for plain connections
+func Open(name string, dbHost string, dbPort int, dbUser string, dbPass string, dbName string, tlsConfig *TLS) (*Tunnel, error) {
+	source, tlsName, err := dsn(name, "tcp", dbHost, dbPort, dbUser, dbPass, dbName, tlsConfig)
 	if err == nil {
-		t := Tunnel{
-			Database:   db,
-			Connection: nil,
+		var db *sql.DB
+		db, err = sql.Open("mysql", source)
+		if err == nil {
+			t := Tunnel{
+				Database: db,
+				tlsName:  tlsName,
+			}
+			return &t, nil
+		}
+		if len(tlsName) > 0 {
+			mysql.DeregisterTLSConfig(tlsName)
 		}
-		return &t, nil
 	}
 	return nil, err
 }
 
-//OpenSSH open a tunnel
-func OpenSSH(sshHost string, sshPort int, sshUser string, sshPass string, dbHost string, dbPort int, dbUser string, dbPass string, dbName string) (*Tunnel, error) {
-	sshConfig := &ssh.ClientConfig{
-		User: sshUser,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(sshPass),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+//OpenSSH open a tunnel, the bastion is redialed whenever the ssh session dies
+func OpenSSH(name string, bastion SSH, dbHost string, dbPort int, dbUser string, dbPass string, dbName string, tlsConfig *TLS) (*Tunnel, error) {
+	d := &viaSSHDialer{
+		bastion: bastion,
+		done:    make(chan struct{}),
+		logger:  slog.Default().With("component", "tunnel", "bastion", bastion.Addr()),
+	}
+	//every pipeline registers its own network so that pipelines do not share ssh clients,
+	//a pipeline which is restarted replaces the dialer of its closed tunnel
+	network := "mysql+ssh-" + name
+	mysql.RegisterDial(network, d.Dial)
+	source, tlsName, err := dsn(name, network, dbHost, dbPort, dbUser, dbPass, dbName, tlsConfig)
+	if err != nil {
+		return nil, err
 	}
-	sshcon, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", sshHost, sshPort), sshConfig)
+	db, err := sql.Open("mysql", source)
 	if err == nil {
-		mysql.RegisterDial("mysql+tcp", (&viaSSHDialer{sshcon}).Dial)
-		db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@mysql+tcp(%s:%d)/%s", dbUser, dbPass, dbHost, dbPort, dbName))
-		if err == nil {
+		//idle connections went through the dead client, shrinking the pool closes them
+		d.onDrop = func() {
+			db.SetMaxIdleConns(0)
+			db.SetMaxIdleConns(idleConns)
+		}
+		if _, err = d.connect(); err == nil {
 			t := Tunnel{
-				Database:   db,
-				Connection: sshcon,
+				Database: db,
+				dialer:   d,
+				tlsName:  tlsName,
 			}
 			return &t, nil
 		}
-		sshcon.Close()
+		db.Close()
+		d.close()
+	}
+	if len(tlsName) > 0 {
+		mysql.DeregisterTLSConfig(tlsName)
 	}
 	return nil, err
 }